@@ -0,0 +1,75 @@
+package beanstalkworker
+
+import "errors"
+import "time"
+import "github.com/beanstalkd/go-beanstalk"
+
+// minTouchInterval stops the auto-touch goroutine from busy looping on jobs with a very short TTR.
+const minTouchInterval = 100 * time.Millisecond
+
+// startAutoTouch starts a goroutine that touches the job shortly before its TTR expires,
+// until the returned stop function is called or the job is deleted, released or buried.
+// The stop function waits for the goroutine to finish.
+func (job *RawJob) startAutoTouch() (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	//Copied as RefreshStats can update them whilst the goroutine is running.
+	timeLeft, ttr := job.timeLeft, job.ttr
+
+	go func() {
+		defer close(finished)
+
+		timer := time.NewTimer(touchInterval(timeLeft, ttr))
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-timer.C:
+				if !job.autoTouch() {
+					return
+				}
+
+				timer.Reset(touchInterval(ttr, ttr))
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// autoTouch touches the job if it has not been disposed of yet.
+// Returns false if the job has been disposed of, or the server no longer has it reserved,
+// and so no longer needs touching.
+func (job *RawJob) autoTouch() bool {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	if job.disposed {
+		return false
+	}
+
+	if err := job.conn.Touch(job.id); err != nil {
+		job.LogError("Could not auto-touch job: ", err)
+		return !errors.Is(err, beanstalk.ErrNotFound)
+	}
+
+	job.metrics.inc(MetricJobsTouched, job.tube)
+	return true
+}
+
+// touchInterval calculates how long to wait before touching a job with the given time left,
+// leaving a safety margin of a quarter of the TTR (at least 1s) before the job would expire.
+func touchInterval(timeLeft time.Duration, ttr time.Duration) time.Duration {
+	interval := timeLeft - ttrMargin(ttr)
+	if interval < minTouchInterval {
+		return minTouchInterval
+	}
+
+	return interval
+}
@@ -0,0 +1,423 @@
+package beanstalkworker
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/beanstalkd/go-beanstalk"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxPipelineDepth is the maximum number of put commands written before reading their responses,
+// which stops the responses from filling the connection's buffers whilst we are still writing.
+const maxPipelineDepth = 512
+
+// defaultAsyncInterval is the interval an AsyncPublisher flushes at if none is given.
+const defaultAsyncInterval = time.Second
+
+// Message is a job to be published as part of a batch.
+type Message struct {
+	Tube    string
+	Data    interface{}
+	Options []PublishOption
+}
+
+// PublishResult is the outcome of publishing a Message, either the new job's id or an error.
+type PublishResult struct {
+	ID  uint64
+	Err error
+}
+
+// encodedMessage is a Message that has been encoded ready to be put.
+type encodedMessage struct {
+	tube    string
+	body    []byte
+	options publishOptions
+}
+
+// pipelineConn is a connection to the beanstalkd server used to pipeline put commands,
+// writing many commands before reading any of their responses.
+type pipelineConn struct {
+	conn *trackedConn
+	r    *bufio.Reader
+	w    *bufio.Writer
+	used string
+}
+
+// PublishBatch encodes and puts many jobs, pipelining the put commands over a single connection
+// so that a batch only takes one round trip to the beanstalkd server per 512 jobs. Returns the
+// result for each message in the same order. Batches are not retried if the connection is lost after
+// the server has responded, as jobs written before the connection was lost may or may not have been put,
+// but are sent again over a new connection if an idle connection was closed by the server. If a spool is set,
+// jobs that fail because the connection was lost are stored in it and may be put twice.
+func (p *Publisher) PublishBatch(ctx context.Context, msgs []Message) []PublishResult {
+	results := make([]PublishResult, len(msgs))
+	encoded := make([]encodedMessage, 0, len(msgs))
+	indexes := make([]int, 0, len(msgs))
+
+	for i, msg := range msgs {
+		//Reject invalid tube names before anything is written, as they would be written into the
+		//use command as they are.
+		err := checkTubeName(msg.Tube)
+		options := newPublishOptions(msg.Options)
+		var body []byte
+		if err == nil {
+			body, err = p.encode(msg.Data, options.headers)
+		}
+
+		if err != nil {
+			results[i].Err = err
+			p.stats.failed.Add(1)
+			p.metrics.inc(MetricPublishErrors, msg.Tube)
+			continue
+		}
+
+		encoded = append(encoded, encodedMessage{tube: msg.Tube, body: body, options: options})
+		indexes = append(indexes, i)
+	}
+
+	p.batchMu.Lock()
+	defer p.batchMu.Unlock()
+
+	//Whilst the server is unreachable, spool jobs without trying it.
+	spool := p.spool.Load()
+	if spool != nil && spool.offline.Load() && spool.pending() > 0 {
+		for i, msg := range encoded {
+			results[indexes[i]].Err = p.spoolJob(spool, msg.tube, msg.body, msg.options)
+		}
+
+		return results
+	}
+
+	for start := 0; start < len(encoded); start += maxPipelineDepth {
+		end := start + maxPipelineDepth
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+
+		chunkResults := p.putPipelined(ctx, encoded[start:end])
+		for i, result := range chunkResults {
+			msg := encoded[start+i]
+			switch {
+			case result.Err == nil:
+				p.stats.published.Add(1)
+				p.metrics.inc(MetricJobsPublished, msg.tube)
+			case isConnectionError(result.Err) && spool != nil:
+				spool.offline.Store(true)
+				result.Err = p.spoolJob(spool, msg.tube, msg.body, msg.options)
+			default:
+				p.stats.failed.Add(1)
+				p.metrics.inc(MetricPublishErrors, msg.tube)
+			}
+
+			results[indexes[start+i]] = result
+		}
+	}
+
+	return results
+}
+
+// putPipelined puts the messages over the pipeline connection in a single round trip,
+// connecting first if needed. The connection is dropped if it fails. If a connection that was
+// left idle fails before the server responds, it was most likely closed by the server whilst idle,
+// so the messages are sent again over a new connection.
+func (p *Publisher) putPipelined(ctx context.Context, msgs []encodedMessage) []PublishResult {
+	reused := p.pipeline != nil
+	results, responded := p.sendPipelined(ctx, msgs)
+	if reused && !responded && isConnectionError(results[0].Err) {
+		p.log.Error("Error publishing batch over idle connection, reconnecting: ", results[0].Err)
+		results, _ = p.sendPipelined(ctx, msgs)
+	}
+
+	return results
+}
+
+// sendPipelined writes the put commands for the messages and then reads all of their responses,
+// also reporting whether the server responded to any of them.
+func (p *Publisher) sendPipelined(ctx context.Context, msgs []encodedMessage) ([]PublishResult, bool) {
+	results := make([]PublishResult, len(msgs))
+	var conn *trackedConn
+	fail := func(from int, err error) ([]PublishResult, bool) {
+		for i := from; i < len(results); i++ {
+			results[i].Err = err
+		}
+
+		return results, conn != nil && conn.responded()
+	}
+
+	if err := ctx.Err(); err != nil {
+		return fail(0, err)
+	}
+
+	if p.pipeline == nil {
+		netConn, err := net.Dial("tcp", p.addr)
+		if err != nil {
+			return fail(0, err)
+		}
+
+		tracked := &trackedConn{Conn: netConn}
+		p.pipeline = &pipelineConn{
+			conn: tracked,
+			r:    bufio.NewReader(tracked),
+			w:    bufio.NewWriter(tracked),
+			used: "default",
+		}
+	}
+
+	pc := p.pipeline
+	conn = pc.conn
+	conn.reset()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	//Write all of the commands, switching tube where needed, then read all of the responses.
+	//The tube used by the connection is only updated once the server has confirmed the switch.
+	uses := make([]bool, len(msgs))
+	using := pc.used
+	for i, msg := range msgs {
+		if msg.tube != using {
+			fmt.Fprintf(pc.w, "use %s\r\n", msg.tube)
+			using = msg.tube
+			uses[i] = true
+		}
+
+		fmt.Fprintf(pc.w, "put %d %d %d %d\r\n", msg.options.prio, durationSeconds(msg.options.delay), durationSeconds(msg.options.ttr), len(msg.body))
+		pc.w.Write(msg.body)
+		pc.w.WriteString("\r\n")
+	}
+
+	if err := pc.w.Flush(); err != nil {
+		p.closePipeline()
+		return fail(0, beanstalk.ConnError{Op: "put", Err: err})
+	}
+
+	p.stats.roundTrips.Add(1)
+
+	var useErr error
+	for i, msg := range msgs {
+		if uses[i] {
+			line, err := pc.readLine()
+			if err != nil {
+				p.closePipeline()
+				return fail(i, beanstalk.ConnError{Op: "use", Err: err})
+			}
+
+			if strings.HasPrefix(line, "USING ") {
+				pc.used = msg.tube
+			} else {
+				useErr = beanstalk.ConnError{Op: "use", Err: responseError(line)}
+			}
+		}
+
+		//If the use failed, the put went into the previously used tube rather than the
+		//one asked for, so report it as an error rather than as published.
+		if msg.tube != pc.used {
+			results[i].Err = useErr
+		}
+
+		line, err := pc.readLine()
+		if err != nil {
+			p.closePipeline()
+			return fail(i, beanstalk.ConnError{Op: "put", Err: err})
+		}
+
+		if results[i].Err != nil {
+			continue
+		}
+
+		if id, ok := strings.CutPrefix(line, "INSERTED "); ok {
+			results[i].ID, err = strconv.ParseUint(id, 10, 64)
+			if err != nil {
+				results[i].Err = beanstalk.ConnError{Op: "put", Err: beanstalk.ErrBadFormat}
+			}
+
+			continue
+		}
+
+		results[i].Err = beanstalk.ConnError{Op: "put", Err: responseError(line)}
+	}
+
+	return results, true
+}
+
+// checkTubeName checks that name is a valid tube name, in the same way as go-beanstalk does
+// before sending a command.
+func checkTubeName(name string) error {
+	switch {
+	case name == "":
+		return beanstalk.NameError{Name: name, Err: beanstalk.ErrEmpty}
+	case len(name) >= 200:
+		return beanstalk.NameError{Name: name, Err: beanstalk.ErrTooLong}
+	case strings.IndexFunc(name, func(r rune) bool { return !strings.ContainsRune(beanstalk.NameChars, r) }) >= 0:
+		return beanstalk.NameError{Name: name, Err: beanstalk.ErrBadChar}
+	}
+
+	return nil
+}
+
+// closePipeline closes the pipeline connection so that the next batch reconnects.
+func (p *Publisher) closePipeline() {
+	if p.pipeline != nil {
+		p.pipeline.conn.Close()
+		p.pipeline = nil
+	}
+}
+
+// readLine reads a single response line.
+func (pc *pipelineConn) readLine() (string, error) {
+	line, err := pc.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// responseErrors maps beanstalkd error responses to the errors returned by go-beanstalk.
+var responseErrors = map[string]error{
+	"BAD_FORMAT":      beanstalk.ErrBadFormat,
+	"BURIED":          beanstalk.ErrBuried,
+	"DRAINING":        beanstalk.ErrDraining,
+	"EXPECTED_CRLF":   beanstalk.ErrNoCRLF,
+	"INTERNAL_ERROR":  beanstalk.ErrInternal,
+	"JOB_TOO_BIG":     beanstalk.ErrJobTooBig,
+	"OUT_OF_MEMORY":   beanstalk.ErrOOM,
+	"UNKNOWN_COMMAND": beanstalk.ErrUnknown,
+}
+
+// responseError returns the error for a beanstalkd error response.
+func responseError(line string) error {
+	word, _, _ := strings.Cut(line, " ")
+	if err, ok := responseErrors[word]; ok {
+		return err
+	}
+
+	return fmt.Errorf("unknown response: %s", line)
+}
+
+// durationSeconds converts a duration to the whole seconds used by the beanstalkd protocol.
+func durationSeconds(d time.Duration) int64 {
+	return int64(d / time.Second)
+}
+
+// AsyncPublisher buffers jobs and publishes them in pipelined batches in the background,
+// flushing whenever the buffer reaches its size or at an interval, whichever comes first.
+// Failures are reported to its error handler. It is safe for concurrent use.
+type AsyncPublisher struct {
+	publisher *Publisher
+	size      int
+	onError   func(msg Message, err error)
+	mu        sync.Mutex
+	buffer    []Message
+	flushCh   chan struct{}
+	closeCh   chan struct{}
+	done      chan struct{}
+	closed    bool
+}
+
+// NewAsync creates an AsyncPublisher that publishes using p. The buffer is flushed once it holds
+// size jobs or every interval, defaulting to every second if interval is not positive.
+// onError is called for each job that could not be published.
+func (p *Publisher) NewAsync(size int, interval time.Duration, onError func(msg Message, err error)) *AsyncPublisher {
+	if size <= 0 {
+		size = 1
+	}
+
+	if interval <= 0 {
+		interval = defaultAsyncInterval
+	}
+
+	a := &AsyncPublisher{
+		publisher: p,
+		size:      size,
+		onError:   onError,
+		buffer:    make([]Message, 0, size),
+		flushCh:   make(chan struct{}, 1),
+		closeCh:   make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	go a.run(interval)
+
+	return a
+}
+
+// Publish adds a job to the buffer to be published in the background.
+// Returns an error if the AsyncPublisher has been closed.
+func (a *AsyncPublisher) Publish(tube string, data interface{}, opts ...PublishOption) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return errors.New("async publisher is closed")
+	}
+
+	a.buffer = append(a.buffer, Message{Tube: tube, Data: data, Options: opts})
+	if len(a.buffer) >= a.size {
+		select {
+		case a.flushCh <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Flush publishes all of the buffered jobs and waits for them to be published.
+func (a *AsyncPublisher) Flush() {
+	a.mu.Lock()
+	msgs := a.buffer
+	a.buffer = make([]Message, 0, a.size)
+	a.mu.Unlock()
+
+	if len(msgs) <= 0 {
+		return
+	}
+
+	results := a.publisher.PublishBatch(context.Background(), msgs)
+	for i, result := range results {
+		if result.Err != nil && a.onError != nil {
+			a.onError(msgs[i], result.Err)
+		}
+	}
+}
+
+// Close stops accepting jobs, publishes any buffered jobs and stops the background goroutine.
+func (a *AsyncPublisher) Close() {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+
+	a.closed = true
+	a.mu.Unlock()
+
+	close(a.closeCh)
+	<-a.done
+	a.Flush()
+}
+
+// run flushes the buffer when it is full or at every interval until the AsyncPublisher is closed.
+func (a *AsyncPublisher) run(interval time.Duration) {
+	defer close(a.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.closeCh:
+			return
+		case <-a.flushCh:
+			a.Flush()
+		case <-ticker.C:
+			a.Flush()
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package beanstalktest
+
+import (
+	"testing"
+	"time"
+)
+
+// pollInterval is how often the wait helpers check the server when nothing has changed,
+// so that delays and TTRs expiring are noticed.
+const pollInterval = 10 * time.Millisecond
+
+// Counts is the number of jobs in each state in a tube.
+type Counts struct {
+	Ready    int
+	Delayed  int
+	Reserved int
+	Buried   int
+}
+
+// jobCounts is the number of jobs in each state, including the ready jobs with an urgent priority.
+type jobCounts struct {
+	Counts
+	urgent int
+}
+
+// countJobs counts the jobs in each state.
+func countJobs(jobs []*job) jobCounts {
+	var counts jobCounts
+	for _, j := range jobs {
+		switch j.State {
+		case StateReady:
+			counts.Ready++
+			if j.Priority < 1024 {
+				counts.urgent++
+			}
+		case StateDelayed:
+			counts.Delayed++
+		case StateReserved:
+			counts.Reserved++
+		case StateBuried:
+			counts.Buried++
+		}
+	}
+
+	return counts
+}
+
+// Job returns a snapshot of the job with id, and whether it exists.
+func (s *Server) Job(id uint64) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tick(time.Now())
+	j, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+
+	return j.snapshot(), true
+}
+
+// Jobs returns snapshots of the jobs in tube, or in all tubes if tube is empty, in id order.
+func (s *Server) Jobs(tube string) []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tick(time.Now())
+	jobs := []Job{}
+	for _, j := range s.sortedJobs(tube) {
+		jobs = append(jobs, j.snapshot())
+	}
+
+	return jobs
+}
+
+// Counts returns the number of jobs in each state in tube.
+func (s *Server) Counts(tube string) Counts {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tick(time.Now())
+	return countJobs(s.sortedJobs(tube)).Counts
+}
+
+// Conns returns the number of client connections the server has open.
+func (s *Server) Conns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.sessions)
+}
+
+// JobState returns the state of the job with id, or StateDeleted if it doesn't exist.
+func (s *Server) JobState(id uint64) string {
+	j, ok := s.Job(id)
+	if !ok {
+		return StateDeleted
+	}
+
+	return j.State
+}
+
+// AssertJobState fails the test if the job with id is not in state.
+// Use StateDeleted to assert that the job no longer exists.
+func (s *Server) AssertJobState(t testing.TB, id uint64, state string) {
+	t.Helper()
+
+	if got := s.JobState(id); got != state {
+		t.Errorf("job %d is %s, want %s", id, got, state)
+	}
+}
+
+// AssertCounts fails the test if the number of jobs in each state in tube is not want.
+func (s *Server) AssertCounts(t testing.TB, tube string, want Counts) {
+	t.Helper()
+
+	if got := s.Counts(tube); got != want {
+		t.Errorf("tube %s has %+v jobs, want %+v", tube, got, want)
+	}
+}
+
+// WaitForJobState waits up to timeout for the job with id to be in state, failing the test if it isn't.
+// Use StateDeleted to wait for the job to be deleted.
+func (s *Server) WaitForJobState(t testing.TB, id uint64, state string, timeout time.Duration) {
+	t.Helper()
+
+	if !s.waitFor(timeout, func() bool { return s.JobState(id) == state }) {
+		t.Fatalf("job %d is %s after %v, want %s", id, s.JobState(id), timeout, state)
+	}
+}
+
+// WaitForCounts waits up to timeout for the number of jobs in each state in tube to be want,
+// failing the test if they aren't.
+func (s *Server) WaitForCounts(t testing.TB, tube string, want Counts, timeout time.Duration) {
+	t.Helper()
+
+	if !s.waitFor(timeout, func() bool { return s.Counts(tube) == want }) {
+		t.Fatalf("tube %s has %+v jobs after %v, want %+v", tube, s.Counts(tube), timeout, want)
+	}
+}
+
+// WaitForConns waits up to timeout for the server to have n client connections open,
+// failing the test if it doesn't.
+func (s *Server) WaitForConns(t testing.TB, n int, timeout time.Duration) {
+	t.Helper()
+
+	if !s.waitFor(timeout, func() bool { return s.Conns() == n }) {
+		t.Fatalf("server has %d connections after %v, want %d", s.Conns(), timeout, n)
+	}
+}
+
+// waitFor waits up to timeout for cond to be true, checking whenever the jobs or connections change.
+func (s *Server) waitFor(timeout time.Duration, cond func() bool) bool {
+	expired := time.After(timeout)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		s.mu.Lock()
+		changed := s.changed
+		s.mu.Unlock()
+
+		if cond() {
+			return true
+		}
+
+		select {
+		case <-changed:
+		case <-ticker.C:
+		case <-expired:
+			return cond()
+		}
+	}
+}
+
+// snapshot returns a copy of the job that is safe to use without the mutex.
+func (j *job) snapshot() Job {
+	snapshot := j.Job
+	snapshot.Body = append([]byte(nil), j.Body...)
+	return snapshot
+}
@@ -0,0 +1,500 @@
+package beanstalktest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/beanstalkd/go-beanstalk"
+	"github.com/tomponline/beanstalkworker"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Methods recorded by MockJob. Calls to TryDelete, TryTouch, TryRelease and TryBury are recorded
+// as MethodDelete, MethodTouch, MethodRelease and MethodBury.
+const (
+	MethodDelete     = "Delete"
+	MethodTouch      = "Touch"
+	MethodRelease    = "Release"
+	MethodBury       = "Bury"
+	MethodDeadLetter = "DeadLetter"
+)
+
+// MethodRefreshStats is the key in MockJob.Errors for the error returned by RefreshStats.
+// Calls to RefreshStats are not recorded, as it doesn't change the job.
+const MethodRefreshStats = "RefreshStats"
+
+// Log levels recorded by MockJob.
+const (
+	LevelError = "error"
+	LevelWarn  = "warn"
+	LevelInfo  = "info"
+	LevelDebug = "debug"
+)
+
+// defaultReturnDelay is the release delay used by the worker when a job was put without a delay.
+const defaultReturnDelay = 60 * time.Second
+
+// Call is a lifecycle method called on a MockJob, with the return priority and delay at the time.
+type Call struct {
+	Method   string
+	Priority uint32
+	Delay    time.Duration
+}
+
+// LogEntry is a message logged on a MockJob.
+type LogEntry struct {
+	Level   string
+	Message string
+}
+
+// MockJob is a beanstalkworker.Job for unit testing handler functions without a beanstalkd server.
+// It records every lifecycle call and logged message. Set the exported fields to preset
+// what the getters return before passing the job to a handler. Errors presets the error
+// returned by each Try lifecycle method, keyed by method name, for example to return
+// beanstalkworker.ErrJobNotFound from TryDelete. It is safe for concurrent use.
+type MockJob struct {
+	ID       uint64
+	Tube     string
+	State    string
+	Body     []byte
+	Headers  map[string]string
+	Age      time.Duration
+	Priority uint32
+	Releases uint32
+	Reserves uint32
+	Timeouts uint32
+	Buries   uint32
+	Kicks    uint32
+	File     uint32
+	Delay    time.Duration
+	TTR      time.Duration
+	TimeLeft time.Duration
+	Server   string
+	Context  context.Context
+	Errors   map[string]error
+
+	mu             sync.Mutex
+	calls          []Call
+	logs           []LogEntry
+	disposed       bool
+	returnPrio     uint32
+	returnPrioSet  bool
+	returnDelay    time.Duration
+	returnDelaySet bool
+}
+
+var _ beanstalkworker.Job = (*MockJob)(nil)
+
+// NewMockJob creates a reserved MockJob with id 1 in tube with body, the default priority and TTR
+// and a reserve count of 1, as if it had just been reserved by a worker.
+func NewMockJob(tube string, body []byte) *MockJob {
+	return &MockJob{
+		ID:       1,
+		Tube:     tube,
+		State:    StateReserved,
+		Body:     body,
+		Headers:  make(map[string]string),
+		Errors:   make(map[string]error),
+		Priority: beanstalkworker.DefaultPriority,
+		Reserves: 1,
+		TTR:      beanstalkworker.DefaultTTR,
+		TimeLeft: beanstalkworker.DefaultTTR,
+		Context:  context.Background(),
+	}
+}
+
+// Delete records a call to delete the job.
+func (m *MockJob) Delete() {
+	m.record(MethodDelete)
+}
+
+// TryDelete records a call to delete the job, returning the preset error for MethodDelete.
+func (m *MockJob) TryDelete() error {
+	return m.record(MethodDelete)
+}
+
+// Touch records a call to touch the job.
+func (m *MockJob) Touch() {
+	m.record(MethodTouch)
+}
+
+// TryTouch records a call to touch the job, returning the preset error for MethodTouch.
+func (m *MockJob) TryTouch() error {
+	return m.record(MethodTouch)
+}
+
+// Release records a call to release the job.
+func (m *MockJob) Release() {
+	m.record(MethodRelease)
+}
+
+// TryRelease records a call to release the job, returning the preset error for MethodRelease.
+func (m *MockJob) TryRelease() error {
+	return m.record(MethodRelease)
+}
+
+// Bury records a call to bury the job.
+func (m *MockJob) Bury() {
+	m.record(MethodBury)
+}
+
+// TryBury records a call to bury the job, returning the preset error for MethodBury.
+func (m *MockJob) TryBury() error {
+	return m.record(MethodBury)
+}
+
+// DeadLetter records a call to move the job to its dead-letter tube, returning the preset
+// error for MethodDeadLetter.
+func (m *MockJob) DeadLetter() error {
+	return m.record(MethodDeadLetter)
+}
+
+// HandleResult records the calls the worker would make for an error returned by a handler function:
+// nil deletes the job, an ActionError takes its action and any other error releases the job.
+// Like the worker, nothing is recorded if the handler has already deleted or released the job.
+// Retry policies are not applied.
+func (m *MockJob) HandleResult(err error) {
+	m.mu.Lock()
+	disposed := m.disposed
+	m.mu.Unlock()
+
+	if disposed {
+		return
+	}
+
+	if err == nil {
+		m.record(MethodDelete)
+		return
+	}
+
+	m.LogError("Handler returned error: ", err)
+
+	var actionErr *beanstalkworker.ActionError
+	if !errors.As(err, &actionErr) {
+		m.record(MethodRelease)
+		return
+	}
+
+	switch actionErr.Action {
+	case beanstalkworker.ActionDeleteJob:
+		m.record(MethodDelete)
+	case beanstalkworker.ActionBuryJob:
+		m.record(MethodBury)
+	case beanstalkworker.ActionDeadLetterJob:
+		m.record(MethodDeadLetter)
+	default:
+		m.record(MethodRelease)
+	}
+}
+
+// LogError records an error message.
+func (m *MockJob) LogError(a ...interface{}) {
+	m.log(LevelError, a)
+}
+
+// LogWarn records a warning message.
+func (m *MockJob) LogWarn(a ...interface{}) {
+	m.log(LevelWarn, a)
+}
+
+// LogInfo records an info message.
+func (m *MockJob) LogInfo(a ...interface{}) {
+	m.log(LevelInfo, a)
+}
+
+// LogDebug records a debug message.
+func (m *MockJob) LogDebug(a ...interface{}) {
+	m.log(LevelDebug, a)
+}
+
+// GetAge returns the preset age.
+func (m *MockJob) GetAge() time.Duration {
+	return m.Age
+}
+
+// GetPriority returns the preset priority.
+func (m *MockJob) GetPriority() uint32 {
+	return m.Priority
+}
+
+// GetReleases returns the preset release count.
+func (m *MockJob) GetReleases() uint32 {
+	return m.Releases
+}
+
+// GetReserves returns the preset reserve count.
+func (m *MockJob) GetReserves() uint32 {
+	return m.Reserves
+}
+
+// GetTimeouts returns the preset timeout count.
+func (m *MockJob) GetTimeouts() uint32 {
+	return m.Timeouts
+}
+
+// GetDelay returns the preset delay.
+func (m *MockJob) GetDelay() time.Duration {
+	return m.Delay
+}
+
+// GetBuries returns the preset bury count.
+func (m *MockJob) GetBuries() uint32 {
+	return m.Buries
+}
+
+// GetKicks returns the preset kick count.
+func (m *MockJob) GetKicks() uint32 {
+	return m.Kicks
+}
+
+// GetID returns the preset id.
+func (m *MockJob) GetID() uint64 {
+	return m.ID
+}
+
+// GetTTR returns the preset TTR.
+func (m *MockJob) GetTTR() time.Duration {
+	return m.TTR
+}
+
+// GetTimeLeft returns the preset time left.
+func (m *MockJob) GetTimeLeft() time.Duration {
+	return m.TimeLeft
+}
+
+// GetState returns the preset state.
+func (m *MockJob) GetState() string {
+	return m.State
+}
+
+// GetFile returns the preset binlog file number.
+func (m *MockJob) GetFile() uint32 {
+	return m.File
+}
+
+// RefreshStats returns the preset error for MethodRefreshStats, leaving the presets unchanged.
+func (m *MockJob) RefreshStats() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.Errors[MethodRefreshStats]
+}
+
+// GetTube returns the preset tube.
+func (m *MockJob) GetTube() string {
+	return m.Tube
+}
+
+// GetBody returns the preset body.
+func (m *MockJob) GetBody() []byte {
+	return m.Body
+}
+
+// GetHeader returns the preset header with the given name.
+func (m *MockJob) GetHeader(name string) string {
+	if value, ok := m.Headers[name]; ok {
+		return value
+	}
+
+	return m.Headers[http.CanonicalHeaderKey(name)]
+}
+
+// GetConn returns nil, as a MockJob has no connection.
+func (m *MockJob) GetConn() *beanstalk.Conn {
+	return nil
+}
+
+// GetServer returns the preset server address.
+func (m *MockJob) GetServer() string {
+	return m.Server
+}
+
+// GetContext returns the preset context, or context.Background if it is nil.
+func (m *MockJob) GetContext() context.Context {
+	if m.Context == nil {
+		return context.Background()
+	}
+
+	return m.Context
+}
+
+// SetReturnPriority sets the priority recorded by subsequent calls to Release.
+func (m *MockJob) SetReturnPriority(prio uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.returnPrio = prio
+	m.returnPrioSet = true
+}
+
+// SetReturnDelay sets the delay recorded by subsequent calls to Release.
+func (m *MockJob) SetReturnDelay(delay time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.returnDelay = delay
+	m.returnDelaySet = true
+}
+
+// Calls returns the lifecycle calls made on the job, in order.
+func (m *MockJob) Calls() []Call {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]Call(nil), m.calls...)
+}
+
+// Logs returns the messages logged on the job, in order.
+func (m *MockJob) Logs() []LogEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]LogEntry(nil), m.logs...)
+}
+
+// Disposal returns the last call that disposed of the job, that is deleted, released, buried or
+// dead-lettered it, and whether there was one.
+func (m *MockJob) Disposal() (Call, bool) {
+	calls := m.Calls()
+	for i := len(calls) - 1; i >= 0; i-- {
+		if calls[i].Method != MethodTouch {
+			return calls[i], true
+		}
+	}
+
+	return Call{}, false
+}
+
+// AssertDeleted fails the test if the job was not deleted.
+func (m *MockJob) AssertDeleted(t testing.TB) {
+	t.Helper()
+	m.assertDisposal(t, MethodDelete)
+}
+
+// AssertReleased fails the test if the job was not released.
+func (m *MockJob) AssertReleased(t testing.TB) {
+	t.Helper()
+	m.assertDisposal(t, MethodRelease)
+}
+
+// AssertReleasedWithDelay fails the test if the job was not released with delay.
+func (m *MockJob) AssertReleasedWithDelay(t testing.TB, delay time.Duration) {
+	t.Helper()
+
+	if call, ok := m.assertDisposal(t, MethodRelease); ok && call.Delay != delay {
+		t.Errorf("job released with delay %v, want %v", call.Delay, delay)
+	}
+}
+
+// AssertReleasedWithPriority fails the test if the job was not released with priority prio.
+func (m *MockJob) AssertReleasedWithPriority(t testing.TB, prio uint32) {
+	t.Helper()
+
+	if call, ok := m.assertDisposal(t, MethodRelease); ok && call.Priority != prio {
+		t.Errorf("job released with priority %d, want %d", call.Priority, prio)
+	}
+}
+
+// AssertBuried fails the test if the job was not buried by HandleResult.
+func (m *MockJob) AssertBuried(t testing.TB) {
+	t.Helper()
+	m.assertDisposal(t, MethodBury)
+}
+
+// AssertDeadLettered fails the test if the job was not dead-lettered by HandleResult.
+func (m *MockJob) AssertDeadLettered(t testing.TB) {
+	t.Helper()
+	m.assertDisposal(t, MethodDeadLetter)
+}
+
+// AssertTouched fails the test if the job was not touched at least once.
+func (m *MockJob) AssertTouched(t testing.TB) {
+	t.Helper()
+
+	for _, call := range m.Calls() {
+		if call.Method == MethodTouch {
+			return
+		}
+	}
+
+	t.Errorf("job not touched, calls were %v", m.Calls())
+}
+
+// AssertNotDisposed fails the test if the job was deleted, released, buried or dead-lettered.
+func (m *MockJob) AssertNotDisposed(t testing.TB) {
+	t.Helper()
+
+	if call, ok := m.Disposal(); ok {
+		t.Errorf("job disposed by %s, want no disposal", call.Method)
+	}
+}
+
+// AssertLogged fails the test if no message was logged at level.
+func (m *MockJob) AssertLogged(t testing.TB, level string) {
+	t.Helper()
+
+	for _, entry := range m.Logs() {
+		if entry.Level == level {
+			return
+		}
+	}
+
+	t.Errorf("no %s message logged, logs were %v", level, m.Logs())
+}
+
+// assertDisposal fails the test if the job was not last disposed of by method, returning the call.
+func (m *MockJob) assertDisposal(t testing.TB, method string) (Call, bool) {
+	t.Helper()
+
+	call, ok := m.Disposal()
+	if !ok {
+		t.Errorf("job not disposed, want %s", method)
+		return call, false
+	}
+
+	if call.Method != method {
+		t.Errorf("job disposed by %s, want %s", call.Method, method)
+		return call, false
+	}
+
+	return call, true
+}
+
+// record records a lifecycle call with the current return priority and delay, which default
+// to the job's priority and delay (or 60s if it has no delay) as they do for a reserved job.
+// Returns the preset error for the method.
+func (m *MockJob) record(method string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	call := Call{Method: method, Priority: m.Priority, Delay: m.Delay}
+	if call.Delay <= 0 {
+		call.Delay = defaultReturnDelay
+	}
+
+	if m.returnPrioSet {
+		call.Priority = m.returnPrio
+	}
+
+	if m.returnDelaySet {
+		call.Delay = m.returnDelay
+	}
+
+	m.calls = append(m.calls, call)
+	if method != MethodTouch {
+		m.disposed = true
+	}
+
+	return m.Errors[method]
+}
+
+// log records a logged message.
+func (m *MockJob) log(level string, a []interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.logs = append(m.logs, LogEntry{Level: level, Message: fmt.Sprint(a...)})
+}
@@ -0,0 +1,123 @@
+package beanstalktest_test
+
+import "github.com/tomponline/beanstalkworker"
+import "github.com/tomponline/beanstalkworker/beanstalktest"
+import "errors"
+import "fmt"
+import "testing"
+import "time"
+
+// retryLater is a handler that releases jobs with a delay based on how many times they've been released.
+func retryLater(jobMgr beanstalkworker.Job, data string) {
+	if data == "ok" {
+		jobMgr.Delete()
+		return
+	}
+
+	jobMgr.LogWarn("Retrying job in tube ", jobMgr.GetTube())
+	jobMgr.SetReturnPriority(jobMgr.GetPriority() + 1)
+	jobMgr.SetReturnDelay(time.Duration(jobMgr.GetReleases()+1) * time.Minute)
+	jobMgr.Release()
+}
+
+func TestMockJob(t *testing.T) {
+	job := beanstalktest.NewMockJob("jobs", nil)
+	job.Releases = 2
+	job.Priority = 10
+
+	retryLater(job, "retry")
+
+	job.AssertReleasedWithDelay(t, 3*time.Minute)
+	job.AssertReleasedWithPriority(t, 11)
+	job.AssertLogged(t, beanstalktest.LevelWarn)
+
+	job = beanstalktest.NewMockJob("jobs", nil)
+	retryLater(job, "ok")
+	job.AssertDeleted(t)
+
+	if calls := job.Calls(); len(calls) != 1 {
+		t.Errorf("calls are %v, want a single delete", calls)
+	}
+}
+
+func TestMockJobHandleResult(t *testing.T) {
+	tests := []struct {
+		err    error
+		method string
+	}{
+		{nil, beanstalktest.MethodDelete},
+		{errors.New("failed"), beanstalktest.MethodRelease},
+		{beanstalkworker.BuryJob(errors.New("bad")), beanstalktest.MethodBury},
+		{beanstalkworker.DeleteJob(errors.New("unwanted")), beanstalktest.MethodDelete},
+		{beanstalkworker.DeadLetterJob(errors.New("poison")), beanstalktest.MethodDeadLetter},
+	}
+
+	for _, test := range tests {
+		job := beanstalktest.NewMockJob("jobs", nil)
+		job.HandleResult(test.err)
+
+		if call, ok := job.Disposal(); !ok || call.Method != test.method {
+			t.Errorf("HandleResult(%v) disposed with %v, want %s", test.err, call, test.method)
+		}
+	}
+}
+
+func TestMockJobHandleResultAfterDisposal(t *testing.T) {
+	//Touching the job doesn't dispose of it.
+	job := beanstalktest.NewMockJob("jobs", nil)
+	job.Touch()
+	job.HandleResult(nil)
+	job.AssertDeleted(t)
+
+	//A handler that releases the job itself and then returns nil leaves the job released.
+	job = beanstalktest.NewMockJob("jobs", nil)
+	job.Release()
+	job.HandleResult(nil)
+	job.AssertReleased(t)
+
+	if calls := job.Calls(); len(calls) != 1 {
+		t.Errorf("Calls after HandleResult = %v, want only the release", calls)
+	}
+
+	//The job counts as disposed of even if the call failed, as it does for the worker.
+	job = beanstalktest.NewMockJob("jobs", nil)
+	job.Errors[beanstalktest.MethodDelete] = beanstalkworker.ErrJobNotFound
+	job.Delete()
+	job.HandleResult(errors.New("failed"))
+	job.AssertDeleted(t)
+
+	if logs := job.Logs(); len(logs) != 0 {
+		t.Errorf("Logs after HandleResult = %v, want none", logs)
+	}
+}
+
+func TestMockJobBury(t *testing.T) {
+	job := beanstalktest.NewMockJob("jobs", nil)
+	job.Errors[beanstalktest.MethodBury] = beanstalkworker.ErrJobNotFound
+
+	if err := job.TryBury(); !errors.Is(err, beanstalkworker.ErrJobNotFound) {
+		t.Errorf("TryBury returned %v, want the preset error", err)
+	}
+
+	job.AssertBuried(t)
+
+	job = beanstalktest.NewMockJob("jobs", nil)
+	if err := job.DeadLetter(); err != nil {
+		t.Errorf("DeadLetter returned %v", err)
+	}
+
+	//The handler has disposed of the job, so the result it returns is not acted on.
+	job.HandleResult(errors.New("failed"))
+	job.AssertDeadLettered(t)
+}
+
+func ExampleMockJob() {
+	job := beanstalktest.NewMockJob("jobs", []byte(`"retry"`))
+	job.Releases = 1
+
+	retryLater(job, "retry")
+
+	call, _ := job.Disposal()
+	fmt.Println(call.Method, call.Priority, call.Delay)
+	// Output: Release 1025 2m0s
+}
@@ -0,0 +1,947 @@
+// Package beanstalktest provides an in-process fake beanstalkd server for testing
+// workers and publishers without running a real beanstalkd.
+//
+// The server speaks enough of the beanstalkd protocol for the go-beanstalk client:
+// put, use, reserve, reserve-with-timeout, delete, release, bury, touch, kick, kick-job,
+// peek, watch, ignore, stats, stats-job, stats-tube, list-tubes and quit.
+// Jobs are held in memory and are lost when the server is closed.
+package beanstalktest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// States of a job, as reported by stats-job. StateDeleted is never reported by the server,
+// it is used by the assertion helpers for a job that no longer exists.
+const (
+	StateReady    = "ready"
+	StateDelayed  = "delayed"
+	StateReserved = "reserved"
+	StateBuried   = "buried"
+	StateDeleted  = "deleted"
+)
+
+// DefaultTube is the tube that connections use and watch until told otherwise.
+const DefaultTube = "default"
+
+// MaxJobSize is the largest job body the server accepts, the same as beanstalkd's default.
+const MaxJobSize = 65535
+
+// deadlineSafetyMargin is how close to its TTR a reserved job must be for reserve to respond DEADLINE_SOON.
+const deadlineSafetyMargin = time.Second
+
+// maxTubeNameLength is the longest tube name beanstalkd accepts.
+const maxTubeNameLength = 200
+
+// Job is a snapshot of a job held by the server.
+type Job struct {
+	ID       uint64
+	Tube     string
+	State    string
+	Priority uint32
+	Body     []byte
+	Delay    time.Duration
+	TTR      time.Duration
+	Created  time.Time
+	Reserves uint64
+	Releases uint64
+	Timeouts uint64
+	Buries   uint64
+	Kicks    uint64
+}
+
+// job is a job held by the server.
+type job struct {
+	Job
+	readyAt  time.Time // When a delayed job becomes ready.
+	deadline time.Time // When a reserved job's TTR expires.
+	owner    *session  // The connection that has reserved the job.
+}
+
+// Server is an in-process fake beanstalkd server listening on a local TCP port.
+type Server struct {
+	// Addr is the address the server listens on, in the form "127.0.0.1:port".
+	Addr string
+
+	listener net.Listener
+	mu       sync.Mutex
+	nextID   uint64
+	jobs     map[uint64]*job
+	tubes    map[string]bool
+	sessions map[*session]bool
+	changed  chan struct{}
+	closed   chan struct{}
+	wg       sync.WaitGroup
+}
+
+// session is a client connection to the server.
+type session struct {
+	s       *Server
+	conn    net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	used    string
+	watched []string
+}
+
+// NewServer starts a fake beanstalkd server on a random local port. It panics if it cannot listen,
+// like httptest.NewServer. The caller should call Close when finished to shut it down.
+func NewServer() *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("beanstalktest: failed to listen on a port: %v", err))
+	}
+
+	s := &Server{
+		Addr:     l.Addr().String(),
+		listener: l,
+		jobs:     make(map[uint64]*job),
+		tubes:    map[string]bool{DefaultTube: true},
+		sessions: make(map[*session]bool),
+		changed:  make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return s
+}
+
+// Close stops the server, closing all client connections, and waits for them to finish.
+func (s *Server) Close() {
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		return
+	default:
+	}
+
+	close(s.closed)
+	s.listener.Close()
+	for sess := range s.sessions {
+		sess.conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
+
+// CloseClientConnections closes all current client connections, leaving the server running.
+// This is useful for testing how clients handle losing their connection.
+func (s *Server) CloseClientConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for sess := range s.sessions {
+		sess.conn.Close()
+	}
+}
+
+// Put adds a job to tube directly, without a client connection, returning its id.
+func (s *Server) Put(tube string, body []byte, prio uint32, delay time.Duration, ttr time.Duration) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.put(tube, body, prio, delay, ttr)
+}
+
+// serve accepts client connections until the server is closed.
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		sess := &session{
+			s:       s,
+			conn:    conn,
+			r:       bufio.NewReader(conn),
+			w:       bufio.NewWriter(conn),
+			used:    DefaultTube,
+			watched: []string{DefaultTube},
+		}
+
+		s.mu.Lock()
+		select {
+		case <-s.closed:
+			s.mu.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+
+		s.sessions[sess] = true
+		s.notify()
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go sess.serve()
+	}
+}
+
+// put adds a new job. Must be called with the mutex held.
+func (s *Server) put(tube string, body []byte, prio uint32, delay time.Duration, ttr time.Duration) uint64 {
+	if ttr < time.Second {
+		ttr = time.Second
+	}
+
+	s.nextID++
+	j := &job{Job: Job{
+		ID:       s.nextID,
+		Tube:     tube,
+		State:    StateReady,
+		Priority: prio,
+		Body:     body,
+		Delay:    delay,
+		TTR:      ttr,
+		Created:  time.Now(),
+	}}
+
+	if delay > 0 {
+		j.State = StateDelayed
+		j.readyAt = j.Created.Add(delay)
+	}
+
+	s.jobs[j.ID] = j
+	s.tubes[tube] = true
+	s.notify()
+
+	return j.ID
+}
+
+// notify wakes up anything waiting for the jobs to change. Must be called with the mutex held.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// tick makes delayed jobs whose delay has passed ready, and reserved jobs whose TTR has expired ready,
+// returning when the next job will change state. Must be called with the mutex held.
+func (s *Server) tick(now time.Time) time.Time {
+	var next time.Time
+	for _, j := range s.jobs {
+		switch j.State {
+		case StateDelayed:
+			if !now.Before(j.readyAt) {
+				j.State = StateReady
+				s.notify()
+			} else if next.IsZero() || j.readyAt.Before(next) {
+				next = j.readyAt
+			}
+		case StateReserved:
+			if !now.Before(j.deadline) {
+				j.State = StateReady
+				j.owner = nil
+				j.Timeouts++
+				s.notify()
+			} else if next.IsZero() || j.deadline.Before(next) {
+				next = j.deadline
+			}
+		}
+	}
+
+	return next
+}
+
+// readyJob returns the ready job with the most urgent priority, then the lowest id, in any of the tubes.
+// Must be called with the mutex held.
+func (s *Server) readyJob(tubes []string) *job {
+	var found *job
+	for _, j := range s.jobs {
+		if j.State != StateReady || !contains(tubes, j.Tube) {
+			continue
+		}
+
+		if found == nil || j.Priority < found.Priority || (j.Priority == found.Priority && j.ID < found.ID) {
+			found = j
+		}
+	}
+
+	return found
+}
+
+// sortedJobs returns the jobs in a tube, or all tubes if tube is empty, in id order.
+// Must be called with the mutex held.
+func (s *Server) sortedJobs(tube string) []*job {
+	jobs := make([]*job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		if tube == "" || j.Tube == tube {
+			jobs = append(jobs, j)
+		}
+	}
+
+	sort.Slice(jobs, func(a, b int) bool {
+		return jobs[a].ID < jobs[b].ID
+	})
+
+	return jobs
+}
+
+// serve reads and handles commands until the connection is closed, then releases any jobs
+// the connection still has reserved, as beanstalkd does.
+func (sess *session) serve() {
+	s := sess.s
+	defer s.wg.Done()
+	defer func() {
+		sess.conn.Close()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		delete(s.sessions, sess)
+		s.notify()
+		for _, j := range s.jobs {
+			if j.owner == sess {
+				j.State = StateReady
+				j.owner = nil
+				s.notify()
+			}
+		}
+	}()
+
+	for {
+		line, err := sess.r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		args := strings.Fields(strings.TrimRight(line, "\r\n"))
+		if len(args) == 0 {
+			sess.reply("UNKNOWN_COMMAND")
+		} else if args[0] == "quit" {
+			return
+		} else if err := sess.command(args[0], args[1:]); err != nil {
+			return
+		}
+
+		if err := sess.w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// command handles a single command. An error is returned only if the connection has failed.
+func (sess *session) command(name string, args []string) error {
+	switch name {
+	case "put":
+		return sess.cmdPut(args)
+	case "use":
+		return sess.cmdUse(args)
+	case "watch":
+		return sess.cmdWatch(args)
+	case "ignore":
+		return sess.cmdIgnore(args)
+	case "reserve":
+		if len(args) != 0 {
+			return sess.reply("BAD_FORMAT")
+		}
+
+		return sess.reserve(-1)
+	case "reserve-with-timeout":
+		seconds, ok := parseArgs(args, 1)
+		if !ok {
+			return sess.reply("BAD_FORMAT")
+		}
+
+		return sess.reserve(time.Duration(seconds[0]) * time.Second)
+	case "delete":
+		return sess.cmdDelete(args)
+	case "release":
+		return sess.cmdRelease(args)
+	case "bury":
+		return sess.cmdBury(args)
+	case "touch":
+		return sess.cmdTouch(args)
+	case "kick":
+		return sess.cmdKick(args)
+	case "kick-job":
+		return sess.cmdKickJob(args)
+	case "peek":
+		return sess.cmdPeek(args)
+	case "stats":
+		return sess.cmdStats(args)
+	case "stats-job":
+		return sess.cmdStatsJob(args)
+	case "stats-tube":
+		return sess.cmdStatsTube(args)
+	case "list-tubes":
+		return sess.cmdListTubes(args)
+	}
+
+	return sess.reply("UNKNOWN_COMMAND")
+}
+
+func (sess *session) cmdPut(args []string) error {
+	values, ok := parseArgs(args, 4)
+	if !ok || values[0] > 1<<32-1 {
+		return sess.reply("BAD_FORMAT")
+	}
+
+	size := values[3]
+	if size > MaxJobSize {
+		//Discard the body, then reject the job.
+		if _, err := io.CopyN(io.Discard, sess.r, int64(size)+2); err != nil {
+			return err
+		}
+
+		return sess.reply("JOB_TOO_BIG")
+	}
+
+	body := make([]byte, size+2)
+	if _, err := io.ReadFull(sess.r, body); err != nil {
+		return err
+	}
+
+	if string(body[size:]) != "\r\n" {
+		return sess.reply("EXPECTED_CRLF")
+	}
+
+	s := sess.s
+	s.mu.Lock()
+	id := s.put(sess.used, body[:size], uint32(values[0]), time.Duration(values[1])*time.Second, time.Duration(values[2])*time.Second)
+	s.mu.Unlock()
+
+	return sess.reply("INSERTED %d", id)
+}
+
+func (sess *session) cmdUse(args []string) error {
+	if len(args) != 1 || !validTubeName(args[0]) {
+		return sess.reply("BAD_FORMAT")
+	}
+
+	sess.used = args[0]
+
+	sess.s.mu.Lock()
+	sess.s.tubes[args[0]] = true
+	sess.s.mu.Unlock()
+
+	return sess.reply("USING %s", args[0])
+}
+
+func (sess *session) cmdWatch(args []string) error {
+	if len(args) != 1 || !validTubeName(args[0]) {
+		return sess.reply("BAD_FORMAT")
+	}
+
+	if !contains(sess.watched, args[0]) {
+		sess.watched = append(sess.watched, args[0])
+	}
+
+	sess.s.mu.Lock()
+	sess.s.tubes[args[0]] = true
+	sess.s.mu.Unlock()
+
+	return sess.reply("WATCHING %d", len(sess.watched))
+}
+
+func (sess *session) cmdIgnore(args []string) error {
+	if len(args) != 1 || !validTubeName(args[0]) {
+		return sess.reply("BAD_FORMAT")
+	}
+
+	for i, tube := range sess.watched {
+		if tube != args[0] {
+			continue
+		}
+
+		if len(sess.watched) == 1 {
+			return sess.reply("NOT_IGNORED")
+		}
+
+		sess.watched = append(sess.watched[:i], sess.watched[i+1:]...)
+		break
+	}
+
+	return sess.reply("WATCHING %d", len(sess.watched))
+}
+
+// reserve waits up to timeout for a job in one of the watched tubes, or forever if timeout is negative.
+func (sess *session) reserve(timeout time.Duration) error {
+	s := sess.s
+	expires := time.Now().Add(timeout)
+
+	for {
+		s.mu.Lock()
+		now := time.Now()
+		next := s.tick(now)
+
+		if j := s.readyJob(sess.watched); j != nil {
+			j.State = StateReserved
+			j.owner = sess
+			j.deadline = now.Add(j.TTR)
+			j.Reserves++
+			s.notify()
+
+			id, body := j.ID, j.Body
+			s.mu.Unlock()
+
+			return sess.replyBody(body, "RESERVED %d", id)
+		}
+
+		//Warn the client that a job it has reserved is about to time out.
+		for _, j := range s.jobs {
+			if j.owner != sess {
+				continue
+			}
+
+			soon := j.deadline.Add(-deadlineSafetyMargin)
+			if !now.Before(soon) {
+				s.mu.Unlock()
+				return sess.reply("DEADLINE_SOON")
+			}
+
+			if next.IsZero() || soon.Before(next) {
+				next = soon
+			}
+		}
+
+		if timeout >= 0 && !now.Before(expires) {
+			s.mu.Unlock()
+			return sess.reply("TIMED_OUT")
+		}
+
+		if timeout >= 0 && (next.IsZero() || expires.Before(next)) {
+			next = expires
+		}
+
+		changed := s.changed
+		s.mu.Unlock()
+
+		var timer *time.Timer
+		var wake <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(next.Sub(now))
+			wake = timer.C
+		}
+
+		select {
+		case <-changed:
+		case <-wake:
+		case <-s.closed:
+			return io.EOF
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// reservedJob returns the job with id if it is reserved by the session. Must be called with the mutex held.
+func (sess *session) reservedJob(id uint64) *job {
+	j := sess.s.jobs[id]
+	if j == nil || j.State != StateReserved || j.owner != sess {
+		return nil
+	}
+
+	return j
+}
+
+func (sess *session) cmdDelete(args []string) error {
+	values, ok := parseArgs(args, 1)
+	if !ok {
+		return sess.reply("BAD_FORMAT")
+	}
+
+	s := sess.s
+	s.mu.Lock()
+	s.tick(time.Now())
+	j := s.jobs[values[0]]
+	deletable := j != nil && (j.State != StateReserved || j.owner == sess)
+	if deletable {
+		delete(s.jobs, j.ID)
+		s.notify()
+	}
+	s.mu.Unlock()
+
+	if !deletable {
+		return sess.reply("NOT_FOUND")
+	}
+
+	return sess.reply("DELETED")
+}
+
+func (sess *session) cmdRelease(args []string) error {
+	values, ok := parseArgs(args, 3)
+	if !ok || values[1] > 1<<32-1 {
+		return sess.reply("BAD_FORMAT")
+	}
+
+	s := sess.s
+	s.mu.Lock()
+	now := time.Now()
+	s.tick(now)
+	j := sess.reservedJob(values[0])
+	if j != nil {
+		j.Priority = uint32(values[1])
+		j.Delay = time.Duration(values[2]) * time.Second
+		j.State = StateReady
+		j.owner = nil
+		j.Releases++
+		if j.Delay > 0 {
+			j.State = StateDelayed
+			j.readyAt = now.Add(j.Delay)
+		}
+
+		s.notify()
+	}
+	s.mu.Unlock()
+
+	if j == nil {
+		return sess.reply("NOT_FOUND")
+	}
+
+	return sess.reply("RELEASED")
+}
+
+func (sess *session) cmdBury(args []string) error {
+	values, ok := parseArgs(args, 2)
+	if !ok || values[1] > 1<<32-1 {
+		return sess.reply("BAD_FORMAT")
+	}
+
+	s := sess.s
+	s.mu.Lock()
+	s.tick(time.Now())
+	j := sess.reservedJob(values[0])
+	if j != nil {
+		j.Priority = uint32(values[1])
+		j.State = StateBuried
+		j.owner = nil
+		j.Buries++
+		s.notify()
+	}
+	s.mu.Unlock()
+
+	if j == nil {
+		return sess.reply("NOT_FOUND")
+	}
+
+	return sess.reply("BURIED")
+}
+
+func (sess *session) cmdTouch(args []string) error {
+	values, ok := parseArgs(args, 1)
+	if !ok {
+		return sess.reply("BAD_FORMAT")
+	}
+
+	s := sess.s
+	s.mu.Lock()
+	now := time.Now()
+	s.tick(now)
+	j := sess.reservedJob(values[0])
+	if j != nil {
+		j.deadline = now.Add(j.TTR)
+		s.notify()
+	}
+	s.mu.Unlock()
+
+	if j == nil {
+		return sess.reply("NOT_FOUND")
+	}
+
+	return sess.reply("TOUCHED")
+}
+
+// cmdKick kicks up to bound buried jobs in the used tube, or if there are none, up to bound delayed jobs.
+func (sess *session) cmdKick(args []string) error {
+	values, ok := parseArgs(args, 1)
+	if !ok {
+		return sess.reply("BAD_FORMAT")
+	}
+
+	s := sess.s
+	s.mu.Lock()
+	s.tick(time.Now())
+	jobs := s.sortedJobs(sess.used)
+	state := StateDelayed
+	for _, j := range jobs {
+		if j.State == StateBuried {
+			state = StateBuried
+			break
+		}
+	}
+
+	kicked := uint64(0)
+	for _, j := range jobs {
+		if kicked >= values[0] {
+			break
+		}
+
+		if j.State == state {
+			j.State = StateReady
+			j.Kicks++
+			kicked++
+		}
+	}
+
+	if kicked > 0 {
+		s.notify()
+	}
+	s.mu.Unlock()
+
+	return sess.reply("KICKED %d", kicked)
+}
+
+func (sess *session) cmdKickJob(args []string) error {
+	values, ok := parseArgs(args, 1)
+	if !ok {
+		return sess.reply("BAD_FORMAT")
+	}
+
+	s := sess.s
+	s.mu.Lock()
+	s.tick(time.Now())
+	j := s.jobs[values[0]]
+	kickable := j != nil && (j.State == StateBuried || j.State == StateDelayed)
+	if kickable {
+		j.State = StateReady
+		j.Kicks++
+		s.notify()
+	}
+	s.mu.Unlock()
+
+	if !kickable {
+		return sess.reply("NOT_FOUND")
+	}
+
+	return sess.reply("KICKED")
+}
+
+func (sess *session) cmdPeek(args []string) error {
+	values, ok := parseArgs(args, 1)
+	if !ok {
+		return sess.reply("BAD_FORMAT")
+	}
+
+	s := sess.s
+	s.mu.Lock()
+	j := s.jobs[values[0]]
+	var body []byte
+	if j != nil {
+		body = j.Body
+	}
+	s.mu.Unlock()
+
+	if j == nil {
+		return sess.reply("NOT_FOUND")
+	}
+
+	return sess.replyBody(body, "FOUND %d", values[0])
+}
+
+func (sess *session) cmdStats(args []string) error {
+	if len(args) != 0 {
+		return sess.reply("BAD_FORMAT")
+	}
+
+	s := sess.s
+	s.mu.Lock()
+	s.tick(time.Now())
+	counts := countJobs(s.sortedJobs(""))
+	stats := [][2]interface{}{
+		{"current-jobs-urgent", counts.urgent},
+		{"current-jobs-ready", counts.Ready},
+		{"current-jobs-reserved", counts.Reserved},
+		{"current-jobs-delayed", counts.Delayed},
+		{"current-jobs-buried", counts.Buried},
+		{"total-jobs", s.nextID},
+		{"current-tubes", len(s.tubes)},
+		{"current-connections", len(s.sessions)},
+		{"version", "beanstalktest"},
+	}
+	s.mu.Unlock()
+
+	return sess.replyYAML(stats)
+}
+
+func (sess *session) cmdStatsJob(args []string) error {
+	values, ok := parseArgs(args, 1)
+	if !ok {
+		return sess.reply("BAD_FORMAT")
+	}
+
+	s := sess.s
+	s.mu.Lock()
+	now := time.Now()
+	s.tick(now)
+	j := s.jobs[values[0]]
+	var stats [][2]interface{}
+	if j != nil {
+		timeLeft := time.Duration(0)
+		switch j.State {
+		case StateReserved:
+			timeLeft = j.deadline.Sub(now)
+		case StateDelayed:
+			timeLeft = j.readyAt.Sub(now)
+		}
+
+		stats = [][2]interface{}{
+			{"id", j.ID},
+			{"tube", j.Tube},
+			{"state", j.State},
+			{"pri", j.Priority},
+			{"age", seconds(now.Sub(j.Created))},
+			{"delay", seconds(j.Delay)},
+			{"ttr", seconds(j.TTR)},
+			{"time-left", seconds(timeLeft)},
+			{"file", 0},
+			{"reserves", j.Reserves},
+			{"timeouts", j.Timeouts},
+			{"releases", j.Releases},
+			{"buries", j.Buries},
+			{"kicks", j.Kicks},
+		}
+	}
+	s.mu.Unlock()
+
+	if j == nil {
+		return sess.reply("NOT_FOUND")
+	}
+
+	return sess.replyYAML(stats)
+}
+
+func (sess *session) cmdStatsTube(args []string) error {
+	if len(args) != 1 || !validTubeName(args[0]) {
+		return sess.reply("BAD_FORMAT")
+	}
+
+	s := sess.s
+	s.mu.Lock()
+	s.tick(time.Now())
+	exists := s.tubes[args[0]]
+	jobs := s.sortedJobs(args[0])
+	counts := countJobs(jobs)
+	stats := [][2]interface{}{
+		{"name", args[0]},
+		{"current-jobs-urgent", counts.urgent},
+		{"current-jobs-ready", counts.Ready},
+		{"current-jobs-reserved", counts.Reserved},
+		{"current-jobs-delayed", counts.Delayed},
+		{"current-jobs-buried", counts.Buried},
+		{"total-jobs", len(jobs)},
+	}
+	s.mu.Unlock()
+
+	if !exists {
+		return sess.reply("NOT_FOUND")
+	}
+
+	return sess.replyYAML(stats)
+}
+
+func (sess *session) cmdListTubes(args []string) error {
+	if len(args) != 0 {
+		return sess.reply("BAD_FORMAT")
+	}
+
+	s := sess.s
+	s.mu.Lock()
+	tubes := make([]string, 0, len(s.tubes))
+	for tube := range s.tubes {
+		tubes = append(tubes, tube)
+	}
+	s.mu.Unlock()
+
+	sort.Strings(tubes)
+
+	var b strings.Builder
+	b.WriteString("---\n")
+	for _, tube := range tubes {
+		fmt.Fprintf(&b, "- %s\n", tube)
+	}
+
+	return sess.replyBody([]byte(b.String()), "OK")
+}
+
+// reply writes a response line.
+func (sess *session) reply(format string, a ...interface{}) error {
+	fmt.Fprintf(sess.w, format, a...)
+	_, err := sess.w.WriteString("\r\n")
+	return err
+}
+
+// replyBody writes a response line followed by the size of body and body itself.
+func (sess *session) replyBody(body []byte, format string, a ...interface{}) error {
+	fmt.Fprintf(sess.w, format, a...)
+	fmt.Fprintf(sess.w, " %d\r\n", len(body))
+	sess.w.Write(body)
+	_, err := sess.w.WriteString("\r\n")
+	return err
+}
+
+// replyYAML writes an OK response with the stats as a YAML dictionary.
+func (sess *session) replyYAML(stats [][2]interface{}) error {
+	var b strings.Builder
+	b.WriteString("---\n")
+	for _, stat := range stats {
+		fmt.Fprintf(&b, "%s: %v\n", stat[0], stat[1])
+	}
+
+	return sess.replyBody([]byte(b.String()), "OK")
+}
+
+// parseArgs parses exactly n unsigned integer arguments.
+func parseArgs(args []string, n int) ([]uint64, bool) {
+	if len(args) != n {
+		return nil, false
+	}
+
+	values := make([]uint64, n)
+	for i, arg := range args {
+		value, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return nil, false
+		}
+
+		values[i] = value
+	}
+
+	return values, true
+}
+
+// validTubeName returns whether name is a tube name that beanstalkd accepts.
+func validTubeName(name string) bool {
+	if name == "" || len(name) > maxTubeNameLength || name[0] == '-' {
+		return false
+	}
+
+	for _, c := range name {
+		if !strings.ContainsRune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-+/;.$_()", c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// seconds returns d as a whole number of seconds, as beanstalkd reports durations.
+func seconds(d time.Duration) int64 {
+	return int64(d / time.Second)
+}
+
+// contains returns whether tubes contains tube.
+func contains(tubes []string, tube string) bool {
+	for _, t := range tubes {
+		if t == tube {
+			return true
+		}
+	}
+
+	return false
+}
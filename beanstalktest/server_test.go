@@ -0,0 +1,178 @@
+package beanstalktest_test
+
+import "github.com/beanstalkd/go-beanstalk"
+import "github.com/tomponline/beanstalkworker/beanstalktest"
+import "errors"
+import "testing"
+import "time"
+
+// dial connects a go-beanstalk client to the server.
+func dial(t *testing.T, srv *beanstalktest.Server) *beanstalk.Conn {
+	t.Helper()
+
+	conn, err := beanstalk.Dial("tcp", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestServerLifecycle(t *testing.T) {
+	srv := beanstalktest.NewServer()
+	defer srv.Close()
+
+	conn := dial(t, srv)
+	tube := beanstalk.NewTube(conn, "jobs")
+	tubes := beanstalk.NewTubeSet(conn, "jobs")
+
+	id, err := tube.Put([]byte("hello"), 10, 0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.AssertJobState(t, id, beanstalktest.StateReady)
+
+	reservedID, body, err := tubes.Reserve(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reservedID != id || string(body) != "hello" {
+		t.Fatalf("Reserve returned %d %q, want %d %q", reservedID, body, id, "hello")
+	}
+
+	stats, err := conn.StatsJob(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats["state"] != "reserved" || stats["tube"] != "jobs" || stats["reserves"] != "1" || stats["ttr"] != "60" {
+		t.Fatalf("StatsJob returned %v", stats)
+	}
+
+	if err := conn.Touch(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.Bury(id, 20); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.AssertCounts(t, "jobs", beanstalktest.Counts{Buried: 1})
+
+	if n, err := tube.Kick(10); err != nil || n != 1 {
+		t.Fatalf("Kick returned %d, %v, want 1", n, err)
+	}
+
+	if _, _, err := tubes.Reserve(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.Release(id, 30, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	job, ok := srv.Job(id)
+	if !ok || job.State != beanstalktest.StateDelayed || job.Priority != 30 || job.Releases != 1 || job.Buries != 1 || job.Kicks != 1 {
+		t.Fatalf("Job after release is %+v", job)
+	}
+
+	if err := conn.KickJob(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.AssertJobState(t, id, beanstalktest.StateDeleted)
+
+	if err := conn.Delete(id); !errors.Is(err, beanstalk.ErrNotFound) {
+		t.Fatalf("Delete of deleted job returned %v, want ErrNotFound", err)
+	}
+}
+
+func TestServerReserve(t *testing.T) {
+	srv := beanstalktest.NewServer()
+	defer srv.Close()
+
+	conn := dial(t, srv)
+	tubes := beanstalk.NewTubeSet(conn, "a", "b")
+
+	if _, _, err := tubes.Reserve(0); !errors.Is(err, beanstalk.ErrTimeout) {
+		t.Fatalf("Reserve of empty tubes returned %v, want ErrTimeout", err)
+	}
+
+	//The most urgent job in any watched tube is reserved first, but not jobs in other tubes.
+	srv.Put("other", []byte("other"), 0, 0, time.Minute)
+	srv.Put("a", []byte("low"), 100, 0, time.Minute)
+	urgent := srv.Put("b", []byte("urgent"), 1, 0, time.Minute)
+
+	if id, _, err := tubes.Reserve(0); err != nil || id != urgent {
+		t.Fatalf("Reserve returned %d, %v, want %d", id, err, urgent)
+	}
+
+	if _, body, err := tubes.Reserve(0); err != nil || string(body) != "low" {
+		t.Fatalf("Reserve returned %q, %v, want %q", body, err, "low")
+	}
+
+	//A reserve waits for a job to be put.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		srv.Put("a", []byte("later"), 0, 0, time.Minute)
+	}()
+
+	if _, body, err := tubes.Reserve(time.Second); err != nil || string(body) != "later" {
+		t.Fatalf("Reserve returned %q, %v, want %q", body, err, "later")
+	}
+
+	//Jobs reserved by a connection that closes are released.
+	conn.Close()
+	srv.WaitForCounts(t, "a", beanstalktest.Counts{Ready: 2}, time.Second)
+	srv.AssertCounts(t, "b", beanstalktest.Counts{Ready: 1})
+}
+
+func TestServerTimeouts(t *testing.T) {
+	srv := beanstalktest.NewServer()
+	defer srv.Close()
+
+	conn := dial(t, srv)
+	tubes := beanstalk.NewTubeSet(conn, "jobs")
+
+	delayed := srv.Put("jobs", nil, 0, time.Second, time.Second)
+	srv.AssertJobState(t, delayed, beanstalktest.StateDelayed)
+
+	//The delayed job becomes ready, then its TTR expires whilst reserved.
+	if id, _, err := tubes.Reserve(2 * time.Second); err != nil || id != delayed {
+		t.Fatalf("Reserve returned %d, %v, want %d", id, err, delayed)
+	}
+
+	if _, _, err := tubes.Reserve(time.Second); !errors.Is(err, beanstalk.ErrDeadline) {
+		t.Fatalf("Reserve with job about to time out returned %v, want ErrDeadline", err)
+	}
+
+	srv.WaitForJobState(t, delayed, beanstalktest.StateReady, 2*time.Second)
+
+	if job, _ := srv.Job(delayed); job.Timeouts != 1 {
+		t.Fatalf("Job timeouts = %d, want 1", job.Timeouts)
+	}
+}
+
+func TestServerConns(t *testing.T) {
+	srv := beanstalktest.NewServer()
+	defer srv.Close()
+
+	conn := dial(t, srv)
+	dial(t, srv)
+	srv.WaitForConns(t, 2, time.Second)
+
+	//Closing the client connections is seen by the clients and the server.
+	srv.CloseClientConnections()
+	srv.WaitForConns(t, 0, time.Second)
+
+	if _, err := conn.ListTubes(); err == nil {
+		t.Fatal("ListTubes succeeded on a closed connection")
+	}
+}
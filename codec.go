@@ -0,0 +1,122 @@
+package beanstalkworker
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Codec encodes and decodes job bodies.
+type Codec interface {
+	Decode(data []byte, v interface{}) error
+	Encode(v interface{}) ([]byte, error)
+	ContentType() string
+}
+
+// JSONCodec encodes and decodes job bodies as JSON. This is the default codec.
+type JSONCodec struct{}
+
+// Decode unmarshals JSON data into v.
+func (JSONCodec) Decode(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// Encode marshals v into JSON.
+func (JSONCodec) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// ContentType returns the JSON content type.
+func (JSONCodec) ContentType() string {
+	return "application/json"
+}
+
+// StrictJSONCodec encodes and decodes job bodies as JSON, but fails to decode bodies
+// that contain unknown fields or trailing data.
+type StrictJSONCodec struct{}
+
+// Decode unmarshals JSON data into v, rejecting unknown fields and trailing data.
+func (StrictJSONCodec) Decode(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("invalid data after top-level JSON value")
+	}
+
+	return nil
+}
+
+// Encode marshals v into JSON.
+func (StrictJSONCodec) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// ContentType returns the JSON content type.
+func (StrictJSONCodec) ContentType() string {
+	return "application/json"
+}
+
+// GobCodec encodes and decodes job bodies using encoding/gob.
+type GobCodec struct{}
+
+// Decode decodes gob data into v.
+func (GobCodec) Decode(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// Encode encodes v using gob.
+func (GobCodec) Encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// ContentType returns the gob content type.
+func (GobCodec) ContentType() string {
+	return "application/x-gob"
+}
+
+// RawCodec passes job bodies through untouched. It decodes into and encodes from
+// []byte and string values.
+type RawCodec struct{}
+
+// Decode copies data into v, which must be a *[]byte or *string.
+func (RawCodec) Decode(data []byte, v interface{}) error {
+	switch v := v.(type) {
+	case *[]byte:
+		*v = append([]byte(nil), data...)
+	case *string:
+		*v = string(data)
+	default:
+		return fmt.Errorf("raw codec cannot decode into %T", v)
+	}
+
+	return nil
+}
+
+// Encode returns v, which must be a []byte or string, as bytes.
+func (RawCodec) Encode(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	default:
+		return nil, fmt.Errorf("raw codec cannot encode %T", v)
+	}
+}
+
+// ContentType returns the binary content type.
+func (RawCodec) ContentType() string {
+	return "application/octet-stream"
+}
@@ -0,0 +1,140 @@
+package beanstalkworker_test
+
+import "github.com/tomponline/beanstalkworker"
+import "github.com/tomponline/beanstalkworker/beanstalktest"
+import "reflect"
+import "testing"
+import "time"
+
+func TestCodecs(t *testing.T) {
+	data := Job1Data{SomeField: "value", SomeOtherField: 1}
+
+	tests := []struct {
+		name        string
+		codec       beanstalkworker.Codec
+		value       interface{}
+		contentType string
+	}{
+		{"json", beanstalkworker.JSONCodec{}, data, "application/json"},
+		{"strict json", beanstalkworker.StrictJSONCodec{}, data, "application/json"},
+		{"gob", beanstalkworker.GobCodec{}, data, "application/x-gob"},
+		{"raw bytes", beanstalkworker.RawCodec{}, []byte("\x00\x01\xff"), "application/octet-stream"},
+		{"raw string", beanstalkworker.RawCodec{}, "text", "application/octet-stream"},
+	}
+
+	for _, test := range tests {
+		body, err := test.codec.Encode(test.value)
+		if err != nil {
+			t.Errorf("%s: Encode: %v", test.name, err)
+			continue
+		}
+
+		//Values decode to what was encoded.
+		decoded := reflect.New(reflect.TypeOf(test.value))
+		if err := test.codec.Decode(body, decoded.Interface()); err != nil {
+			t.Errorf("%s: Decode: %v", test.name, err)
+		} else if !reflect.DeepEqual(decoded.Elem().Interface(), test.value) {
+			t.Errorf("%s: decoded %v, want %v", test.name, decoded.Elem().Interface(), test.value)
+		}
+
+		if got := test.codec.ContentType(); got != test.contentType {
+			t.Errorf("%s: content type %s, want %s", test.name, got, test.contentType)
+		}
+	}
+}
+
+func TestCodecErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec beanstalkworker.Codec
+		body  string
+	}{
+		{"json syntax", beanstalkworker.JSONCodec{}, `{"someField":`},
+		{"strict json unknown field", beanstalkworker.StrictJSONCodec{}, `{"someField":"value","unknown":1}`},
+		{"strict json trailing data", beanstalkworker.StrictJSONCodec{}, `{"someField":"value"} {}`},
+		{"gob not gob", beanstalkworker.GobCodec{}, `{"someField":"value"}`},
+		{"raw into a struct", beanstalkworker.RawCodec{}, "text"},
+	}
+
+	for _, test := range tests {
+		var data Job1Data
+		if err := test.codec.Decode([]byte(test.body), &data); err == nil {
+			t.Errorf("%s: decoded %q as %+v, want an error", test.name, test.body, data)
+		}
+	}
+
+	if _, err := (beanstalkworker.RawCodec{}).Encode(Job1Data{}); err == nil {
+		t.Error("raw codec encoded a struct, want an error")
+	}
+}
+
+func TestWorkerCodecs(t *testing.T) {
+	srv := beanstalktest.NewServer()
+	defer srv.Close()
+
+	decoded := make(chan interface{}, 1)
+	decodeData := func(jobMgr beanstalkworker.Job, data Job1Data) {
+		decoded <- data
+		jobMgr.Delete()
+	}
+
+	decodeString := func(jobMgr beanstalkworker.Job, data string) {
+		decoded <- data
+		jobMgr.Delete()
+	}
+
+	//The worker's codec is used unless the subscription has its own, and any codec failure
+	//takes the unmarshal error action.
+	w := beanstalkworker.NewWorker(srv.Addr)
+	w.SetCodec(beanstalkworker.GobCodec{})
+	w.SetUnmarshalErrorAction(beanstalkworker.ActionBuryJob)
+	beanstalkworker.SubscribeFunc(w, "gob", decodeData)
+	beanstalkworker.SubscribeFunc(w, "json", decodeData, beanstalkworker.WithCodec(beanstalkworker.JSONCodec{}))
+	beanstalkworker.SubscribeFunc(w, "strict", decodeData, beanstalkworker.WithCodec(beanstalkworker.StrictJSONCodec{}))
+	beanstalkworker.SubscribeFunc(w, "raw", decodeString, beanstalkworker.WithCodec(beanstalkworker.RawCodec{}))
+	beanstalkworker.SubscribeFunc(w, "raw-struct", decodeData, beanstalkworker.WithCodec(beanstalkworker.RawCodec{}))
+	runWorker(t, w)
+
+	data := Job1Data{SomeField: "value", SomeOtherField: 1}
+	gobBody, err := beanstalkworker.GobCodec{}.Encode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		tube string
+		body string
+		want interface{} // Nil if the job should be buried.
+	}{
+		{"worker codec", "gob", string(gobBody), data},
+		{"subscription codec", "json", `{"someField":"value","someOtherField":1}`, data},
+		{"raw codec", "raw", "plain text", "plain text"},
+		{"worker codec failure", "gob", `{"someField":"value"}`, nil},
+		{"subscription codec failure", "strict", `{"someField":"value","unknown":1}`, nil},
+		{"raw codec into a struct", "raw-struct", "plain text", nil},
+	}
+
+	for _, test := range tests {
+		id := srv.Put(test.tube, []byte(test.body), 0, 0, time.Minute)
+		if test.want == nil {
+			srv.WaitForJobState(t, id, beanstalktest.StateBuried, waitTimeout)
+			continue
+		}
+
+		select {
+		case got := <-decoded:
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%s: decoded %#v, want %#v", test.name, got, test.want)
+			}
+		case <-time.After(waitTimeout):
+			t.Fatalf("%s: handler not run", test.name)
+		}
+
+		srv.WaitForJobState(t, id, beanstalktest.StateDeleted, waitTimeout)
+	}
+
+	if len(decoded) != 0 {
+		t.Errorf("handler run for a job that could not be decoded: %v", <-decoded)
+	}
+}
@@ -0,0 +1,67 @@
+package beanstalkworker
+
+import (
+	"context"
+	"time"
+)
+
+// ttrSafetyMargin is the least time before a job's TTR expires that its context's deadline is set,
+// or it is auto-touched, so that handlers stop before beanstalkd hands the job to another worker.
+const ttrSafetyMargin = time.Second
+
+// ttrMargin returns how long before a job's TTR expires it should be finished with or touched,
+// a quarter of the TTR but at least ttrSafetyMargin.
+func ttrMargin(ttr time.Duration) time.Duration {
+	margin := ttr / 4
+	if margin < ttrSafetyMargin {
+		margin = ttrSafetyMargin
+	}
+
+	return margin
+}
+
+// contextKey is the type used for the job values stored in a job's context.
+type contextKey int
+
+const (
+	contextKeyTube contextKey = iota
+	contextKeyJobID
+)
+
+// TubeFromContext returns the tube of the job that the context was created for.
+func TubeFromContext(ctx context.Context) (string, bool) {
+	tube, ok := ctx.Value(contextKeyTube).(string)
+	return tube, ok
+}
+
+// JobIDFromContext returns the id of the job that the context was created for.
+func JobIDFromContext(ctx context.Context) (uint64, bool) {
+	id, ok := ctx.Value(contextKeyJobID).(uint64)
+	return id, ok
+}
+
+// newJobContext derives a context for handling the job from the worker's context.
+// It carries the job's tube and id, and unless the job is being auto-touched its deadline
+// is set from the job's time left less a quarter of its TTR (at least 1s). If that would
+// leave less than half of the time left, the deadline is half of the time left instead.
+func newJobContext(ctx context.Context, job *RawJob, autoTouch bool) (context.Context, context.CancelFunc) {
+	ctx = context.WithValue(ctx, contextKeyTube, job.tube)
+	ctx = context.WithValue(ctx, contextKeyJobID, job.id)
+
+	if autoTouch || job.ttr <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	//beanstalkd reports the time left in whole seconds, rounded down.
+	timeLeft := job.timeLeft
+	if timeLeft <= 0 {
+		timeLeft = time.Second
+	}
+
+	timeout := timeLeft - ttrMargin(job.ttr)
+	if timeout < timeLeft/2 {
+		timeout = timeLeft / 2
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
@@ -0,0 +1,87 @@
+package beanstalkworker_test
+
+import "github.com/tomponline/beanstalkworker"
+import "github.com/tomponline/beanstalkworker/beanstalktest"
+import "context"
+import "testing"
+import "time"
+
+func TestWorkerJobContext(t *testing.T) {
+	srv := beanstalktest.NewServer()
+	defer srv.Close()
+
+	type jobContext struct {
+		tube     string
+		id       uint64
+		timeout  time.Duration
+		deadline bool
+	}
+
+	contexts := make(chan jobContext, 1)
+	handler := func(ctx context.Context, jobMgr beanstalkworker.Job, data Job1Data) error {
+		got := jobContext{}
+		got.tube, _ = beanstalkworker.TubeFromContext(ctx)
+		got.id, _ = beanstalkworker.JobIDFromContext(ctx)
+
+		var deadline time.Time
+		deadline, got.deadline = ctx.Deadline()
+		got.timeout = time.Until(deadline)
+		contexts <- got
+		return nil
+	}
+
+	w := beanstalkworker.NewWorker(srv.Addr)
+	beanstalkworker.SubscribeFuncCtx(w, "jobs", handler)
+	beanstalkworker.SubscribeFuncCtx(w, "touched", handler, beanstalkworker.WithAutoTouch())
+	runWorker(t, w)
+
+	//The time left is reported in whole seconds, so is up to a second less than the TTR.
+	tests := []struct {
+		tube     string
+		ttr      time.Duration
+		deadline bool
+		min      time.Duration
+		max      time.Duration
+	}{
+		//Time left less a quarter of the TTR.
+		{"jobs", 60 * time.Second, true, 43 * time.Second, 45 * time.Second},
+		{"jobs", 8 * time.Second, true, 4 * time.Second, 6 * time.Second},
+
+		//Time left less the minimum margin of 1s.
+		{"jobs", 3 * time.Second, true, 900 * time.Millisecond, 2 * time.Second},
+
+		//Half of the time left, as the margin would leave less.
+		{"jobs", time.Second, true, 400 * time.Millisecond, 500 * time.Millisecond},
+
+		//Auto-touched jobs have no deadline.
+		{"touched", time.Second, false, 0, 0},
+	}
+
+	for _, test := range tests {
+		id := srv.Put(test.tube, []byte("{}"), 0, 0, test.ttr)
+
+		var got jobContext
+		select {
+		case got = <-contexts:
+		case <-time.After(waitTimeout):
+			t.Fatalf("handler not run for job with TTR %v", test.ttr)
+		}
+
+		if got.tube != test.tube || got.id != id {
+			t.Errorf("TTR %v: context carries tube %q and job %d, want %q and %d", test.ttr, got.tube, got.id, test.tube, id)
+		}
+
+		if got.deadline != test.deadline || (test.deadline && (got.timeout < test.min || got.timeout > test.max)) {
+			t.Errorf("%s job with TTR %v: deadline %v in %v, want %v between %v and %v", test.tube, test.ttr, got.deadline, got.timeout, test.deadline, test.min, test.max)
+		}
+	}
+
+	//Other contexts don't carry a job.
+	if _, ok := beanstalkworker.TubeFromContext(context.Background()); ok {
+		t.Error("TubeFromContext found a tube in a context without a job")
+	}
+
+	if _, ok := beanstalkworker.JobIDFromContext(context.Background()); ok {
+		t.Error("JobIDFromContext found a job id in a context without a job")
+	}
+}
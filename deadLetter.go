@@ -0,0 +1,31 @@
+package beanstalkworker
+
+import (
+	"strings"
+	"time"
+)
+
+// DefaultDeadLetterTube is the default name of the tube that dead-lettered jobs are put into.
+const DefaultDeadLetterTube = "{tube}.dlq"
+
+// DeadLetter is the envelope a job is wrapped in when it is put into a dead-letter tube.
+type DeadLetter struct {
+	Tube     string    `json:"tube"`
+	ID       uint64    `json:"id"`
+	Releases uint32    `json:"releases"`
+	Reserves uint32    `json:"reserves"`
+	Timeouts uint32    `json:"timeouts"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+	Body     []byte    `json:"body"`
+}
+
+// deadLetterTubeName returns the dead-letter tube for a tube, replacing {tube} in name
+// with the original tube name.
+func deadLetterTubeName(name string, tube string) string {
+	if name == "" {
+		name = DefaultDeadLetterTube
+	}
+
+	return strings.ReplaceAll(name, "{tube}", tube)
+}
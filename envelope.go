@@ -0,0 +1,90 @@
+package beanstalkworker
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Well known envelope header names.
+const (
+	HeaderContentType   = "Content-Type"
+	HeaderCorrelationID = "Correlation-Id"
+	HeaderSchemaVersion = "Schema-Version"
+	HeaderProducer      = "Producer"
+	HeaderEnqueuedAt    = "Enqueued-At"
+)
+
+// Envelope is an optional job body format that carries headers alongside the payload,
+// such as a correlation id, content type, schema version, producer name or enqueue time.
+// Enveloped jobs are detected and unwrapped before the payload is decoded, so enveloped
+// and non-enveloped jobs can be mixed on the same tube.
+//
+// If the Content-Type header is a JSON type (or not set) the payload is the JSON value
+// itself, otherwise it is a JSON string containing the base64 encoded payload.
+type Envelope struct {
+	Headers map[string]string `json:"headers"`
+	Payload json.RawMessage   `json:"payload"`
+}
+
+// wrapEnvelope wraps payload in an Envelope with the given headers. The payload is base64 encoded
+// unless the Content-Type header is a JSON type.
+func wrapEnvelope(headers map[string]string, payload []byte) ([]byte, error) {
+	envelope := Envelope{
+		Headers: headers,
+		Payload: payload,
+	}
+
+	if !isJSONContentType(headers[HeaderContentType]) {
+		encoded, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+
+		envelope.Payload = encoded
+	}
+
+	return json.Marshal(envelope)
+}
+
+// unwrapEnvelope detects whether body is an Envelope and if so returns its headers, with their names
+// canonicalised, and its decoded payload.
+func unwrapEnvelope(body []byte) (map[string]string, []byte, bool) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 || trimmed[0] != '{' || !bytes.Contains(trimmed, []byte(`"payload"`)) || !bytes.Contains(trimmed, []byte(`"headers"`)) {
+		return nil, nil, false
+	}
+
+	//Only treat the body as an envelope if it has exactly the envelope's fields.
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(trimmed, &fields); err != nil || len(fields) != 2 || fields["headers"] == nil || fields["payload"] == nil {
+		return nil, nil, false
+	}
+
+	var envelope Envelope
+	if err := json.Unmarshal(trimmed, &envelope); err != nil {
+		return nil, nil, false
+	}
+
+	headers := make(map[string]string, len(envelope.Headers))
+	for name, value := range envelope.Headers {
+		headers[http.CanonicalHeaderKey(name)] = value
+	}
+
+	payload := []byte(envelope.Payload)
+	if !isJSONContentType(headers[HeaderContentType]) {
+		if err := json.Unmarshal(envelope.Payload, &payload); err != nil {
+			return nil, nil, false
+		}
+	}
+
+	return headers, payload, true
+}
+
+// isJSONContentType reports whether a content type is JSON. An empty content type is assumed to be JSON.
+func isJSONContentType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	return mediaType == "" || mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
@@ -0,0 +1,66 @@
+package beanstalkworker_test
+
+import "github.com/tomponline/beanstalkworker"
+import "reflect"
+import "testing"
+
+func TestWrapEnvelope(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		payload string
+		want    string
+	}{
+		{"json", map[string]string{"Content-Type": "application/json"}, `{"a":1}`, `{"headers":{"Content-Type":"application/json"},"payload":{"a":1}}`},
+		{"json suffix", map[string]string{"Content-Type": "application/vnd.test+json"}, `[1]`, `{"headers":{"Content-Type":"application/vnd.test+json"},"payload":[1]}`},
+		{"no content type", map[string]string{"Producer": "test"}, `"text"`, `{"headers":{"Producer":"test"},"payload":"text"}`},
+		{"base64", map[string]string{"Content-Type": "text/plain"}, "hello", `{"headers":{"Content-Type":"text/plain"},"payload":"aGVsbG8="}`},
+	}
+
+	for _, test := range tests {
+		body, err := beanstalkworker.WrapEnvelope(test.headers, []byte(test.payload))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if string(body) != test.want {
+			t.Errorf("%s: wrapped as %s, want %s", test.name, body, test.want)
+		}
+
+		//Wrapped jobs unwrap to the same headers and payload.
+		headers, payload, ok := beanstalkworker.UnwrapEnvelope(body)
+		if !ok || !reflect.DeepEqual(headers, test.headers) || string(payload) != test.payload {
+			t.Errorf("%s: unwrapped as %v %q %v", test.name, headers, payload, ok)
+		}
+	}
+}
+
+func TestUnwrapEnvelope(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		headers map[string]string
+		payload string
+		ok      bool
+	}{
+		{"json", `{"headers":{"Content-Type":"application/json"},"payload":{"a":1}}`, map[string]string{"Content-Type": "application/json"}, `{"a":1}`, true},
+		{"canonical header names", ` {"payload":1,"headers":{"content-type":"application/json","CORRELATION-ID":"abc"}} `, map[string]string{"Content-Type": "application/json", "Correlation-Id": "abc"}, `1`, true},
+		{"base64", `{"headers":{"Content-Type":"application/octet-stream"},"payload":"AAH/"}`, map[string]string{"Content-Type": "application/octet-stream"}, "\x00\x01\xff", true},
+		{"base64 payload not a string", `{"headers":{"Content-Type":"text/plain"},"payload":{"a":1}}`, nil, "", false},
+		{"legacy body with extra fields", `{"headers":{"a":"b"},"payload":{"c":1},"id":5}`, nil, "", false},
+		{"headers not an object", `{"headers":["a"],"payload":{}}`, nil, "", false},
+		{"missing headers", `{"payload":{},"id":"headers"}`, nil, "", false},
+		{"missing payload", `{"headers":{},"id":"payload"}`, nil, "", false},
+		{"not an object", `["headers","payload"]`, nil, "", false},
+		{"not json", `headers payload`, nil, "", false},
+		{"empty", ``, nil, "", false},
+	}
+
+	for _, test := range tests {
+		headers, payload, ok := beanstalkworker.UnwrapEnvelope([]byte(test.body))
+		if ok != test.ok || !reflect.DeepEqual(headers, test.headers) || string(payload) != test.payload {
+			t.Errorf("%s: unwrapped as %v %q %v, want %v %q %v", test.name, headers, payload, ok, test.headers, test.payload, test.ok)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package beanstalkworker
+
+import (
+	"errors"
+	"fmt"
+	"github.com/beanstalkd/go-beanstalk"
+	"io"
+	"net"
+	"strconv"
+)
+
+// ErrInvalidConfig is wrapped by the errors Run returns when the worker is misconfigured,
+// before any connections are made.
+var ErrInvalidConfig = errors.New("invalid worker configuration")
+
+// Configuration errors returned by Run, all of which wrap ErrInvalidConfig.
+var (
+	ErrNoSubscriptions = fmt.Errorf("%w: no job subscriptions defined", ErrInvalidConfig)
+	ErrNoServers       = fmt.Errorf("%w: no beanstalkd server addresses", ErrInvalidConfig)
+	ErrInvalidHandler  = fmt.Errorf("%w: invalid handler", ErrInvalidConfig)
+)
+
+// Errors wrapped by the errors returned from the Job lifecycle methods.
+var (
+	// ErrJobNotFound means the server no longer knows the job as reserved by this worker, for
+	// example because its TTR expired and it was reserved by another worker, or it was deleted.
+	ErrJobNotFound = errors.New("job not found")
+
+	// ErrConnectionLost means the connection to the server was lost, so the command may or may not
+	// have been carried out. The job will be released by the server once its TTR expires.
+	ErrConnectionLost = errors.New("connection lost")
+)
+
+// JobError is returned by the Job lifecycle methods when the command on a job fails.
+// It wraps ErrJobNotFound or ErrConnectionLost where applicable, as well as the error from the
+// beanstalk client, so both can be checked using errors.Is.
+type JobError struct {
+	Op  string
+	ID  uint64
+	Err error
+}
+
+// Error returns the command, the job id and the wrapped error's message.
+func (e *JobError) Error() string {
+	return e.Op + " job " + strconv.FormatUint(e.ID, 10) + ": " + e.Err.Error()
+}
+
+// Unwrap returns ErrJobNotFound or ErrConnectionLost if applicable, and the wrapped error.
+func (e *JobError) Unwrap() []error {
+	switch {
+	case errors.Is(e.Err, beanstalk.ErrNotFound):
+		return []error{ErrJobNotFound, e.Err}
+	case isConnectionError(e.Err):
+		return []error{ErrConnectionLost, e.Err}
+	}
+
+	return []error{e.Err}
+}
+
+// ActionError wraps an error returned by a handler function with the action
+// that should be taken on the job, instead of the default of releasing it.
+type ActionError struct {
+	Action string
+	Err    error
+}
+
+// Error returns the wrapped error's message.
+func (e *ActionError) Error() string {
+	if e.Err == nil {
+		return "job " + e.Action + " requested"
+	}
+
+	return e.Err.Error()
+}
+
+// Unwrap returns the wrapped error.
+func (e *ActionError) Unwrap() error {
+	return e.Err
+}
+
+// BuryJob wraps err so that the job is buried when it is returned from a handler function.
+func BuryJob(err error) error {
+	return &ActionError{Action: ActionBuryJob, Err: err}
+}
+
+// DeleteJob wraps err so that the job is deleted without being retried when it is
+// returned from a handler function.
+func DeleteJob(err error) error {
+	return &ActionError{Action: ActionDeleteJob, Err: err}
+}
+
+// DeadLetterJob wraps err so that the job is moved to its dead-letter tube when it is
+// returned from a handler function.
+func DeadLetterJob(err error) error {
+	return &ActionError{Action: ActionDeadLetterJob, Err: err}
+}
+
+// isConnectionError reports whether err means the connection to the beanstalkd server has been lost
+// or could not be established, rather than the server rejecting the command.
+func isConnectionError(err error) bool {
+	var connErr beanstalk.ConnError
+	if errors.As(err, &connErr) {
+		err = connErr.Err
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed)
+}
@@ -0,0 +1,63 @@
+package beanstalkworker_test
+
+import "github.com/tomponline/beanstalkworker"
+import "context"
+import "log"
+import "time"
+
+func ExamplePublisher() {
+	//Define a new publisher - how to connect to the beanstalkd server.
+	publisher := beanstalkworker.NewPublisher("127.0.0.1:11300")
+	defer publisher.Close()
+
+	//Optional header sent with every job, jobs are wrapped in an envelope to carry headers.
+	publisher.SetHeader(beanstalkworker.HeaderProducer, "example-service")
+
+	//Publish a job, encoded using the same codec the worker decodes it with.
+	jobData := Job1Data{
+		SomeField:      "some value",
+		SomeOtherField: 123,
+	}
+
+	id, err := publisher.Publish(context.Background(), "job1", jobData,
+		beanstalkworker.WithPriority(10),
+		beanstalkworker.WithDelay(5*time.Second),
+		beanstalkworker.WithTTR(2*time.Minute),
+		beanstalkworker.WithHeader(beanstalkworker.HeaderCorrelationID, "abc123"),
+	)
+	if err != nil {
+		log.Print("Error publishing job: ", err)
+		return
+	}
+
+	log.Print("Published job ", id)
+}
+
+func ExamplePublisher_PublishBatch() {
+	publisher := beanstalkworker.NewPublisher("127.0.0.1:11300")
+	defer publisher.Close()
+
+	//The put commands are pipelined over a single connection.
+	msgs := []beanstalkworker.Message{
+		{Tube: "job1", Data: Job1Data{SomeField: "first"}},
+		{Tube: "job1", Data: Job1Data{SomeField: "second"}, Options: []beanstalkworker.PublishOption{beanstalkworker.WithPriority(10)}},
+	}
+
+	for i, result := range publisher.PublishBatch(context.Background(), msgs) {
+		if result.Err != nil {
+			log.Print("Error publishing job ", i, ": ", result.Err)
+			continue
+		}
+
+		log.Print("Published job ", result.ID)
+	}
+
+	//Alternatively buffer jobs and publish them in batches in the background,
+	//flushing every 100 jobs or every second.
+	async := publisher.NewAsync(100, time.Second, func(msg beanstalkworker.Message, err error) {
+		log.Print("Error publishing job to ", msg.Tube, ": ", err)
+	})
+	defer async.Close()
+
+	async.Publish("job1", Job1Data{SomeField: "third"})
+}
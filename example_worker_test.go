@@ -8,6 +8,9 @@ import "syscall"
 import "log"
 import "fmt"
 import "time"
+import "errors"
+import "net/http"
+import "log/slog"
 
 func Example_worker() {
 	//Setup context for cancelling beanstalk worker.
@@ -17,35 +20,207 @@ func Example_worker() {
 	go signalHandler(cancel)
 
 	//Define a new worker process - how to connect to the beanstalkd server.
+	//More than one server address can be given to consume jobs from all of them.
 	bsWorker := beanstalkworker.NewWorker("127.0.0.1:11300")
 
 	//Optional custom logger - see below.
 	bsWorker.SetLogger(&MyLogger{})
 
+	//Optional middleware that wraps every handler function.
+	bsWorker.Use(func(next beanstalkworker.JobHandler) beanstalkworker.JobHandler {
+		return func(ctx context.Context, jobMgr beanstalkworker.Job) error {
+			start := time.Now()
+			err := next(ctx, jobMgr)
+			jobMgr.LogInfo("Job took ", time.Since(start))
+			return err
+		}
+	})
+
+	//Optional metrics, exposed to Prometheus on http://localhost:9090/metrics
+	metrics := beanstalkworker.NewMetrics()
+	bsWorker.SetMetrics(metrics)
+	http.Handle("/metrics", metrics)
+	go http.ListenAndServe(":9090", nil)
+
 	//Set concurrent worker threads to 2.
 	bsWorker.SetNumWorkers(2)
 
 	//Job is deleted from the queue if unmarshal error appears. We can
-	//decide to bury or release (default behaviour) it as well.
+	//decide to bury, dead-letter or release (default behaviour) it as well.
 	bsWorker.SetUnmarshalErrorAction(beanstalkworker.ActionDeleteJob)
 
+	//Panics in handlers are recovered and the job is buried, the panic can
+	//also be reported to an error tracking service.
+	bsWorker.SetPanicAction(beanstalkworker.ActionBuryJob)
+	bsWorker.SetPanicHandler(func(jobMgr beanstalkworker.Job, recovered interface{}, stack []byte) {
+		log.Printf("Reporting panic in job from %s: %v", jobMgr.GetTube(), recovered)
+	})
+
+	//Optional dead-letter tube name, {tube} is replaced with the job's tube.
+	bsWorker.SetDeadLetterTube("failed-{tube}")
+
+	//Optional retry policy, releases are delayed by 5s, 10s, 20s... and the job
+	//is moved to the dead-letter tube once it has been reserved 5 times.
+	bsWorker.SetRetryPolicy(&beanstalkworker.RetryPolicy{
+		MaxAttempts:  5,
+		BaseDelay:    5 * time.Second,
+		Multiplier:   2,
+		MaxDelay:     time.Minute,
+		Jitter:       0.1,
+		GiveUpAction: beanstalkworker.ActionDeadLetterJob,
+	})
+
 	//Define a common value (example a shared database connection)
 	commonVar := "some common value"
 
 	//Add one or more subcriptions to specific tubes with a handler function.
-	bsWorker.Subscribe("job1", func(jobMgr beanstalkworker.JobManager, jobData Job1Data) {
+	//The job data type is checked at compile time, Subscribe can also be used
+	//with any func that accepts a JobManager (or Job) and a job data value.
+	beanstalkworker.SubscribeFunc(bsWorker, "job1", func(jobMgr beanstalkworker.Job, jobData Job1Data) {
 		//Create a fresh handler struct per job (this ensures fresh state for each job).
 		handler := &Job1Handler{
-			JobManager: jobMgr,    //Embed the JobManager into the handler.
-			commonVar:  commonVar, //Pass the commonVar into the handler.
+			Job:       jobMgr,    //Embed the Job into the handler.
+			commonVar: commonVar, //Pass the commonVar into the handler.
 		}
 
 		handler.Run(jobData)
 	})
 
+	//Subscriptions can have their own worker threads, so that a flood of jobs in
+	//one tube can't starve the others.
+	beanstalkworker.SubscribeFunc(bsWorker, "job2", func(jobMgr beanstalkworker.Job, jobData Job1Data) {
+		jobMgr.LogInfo("Job2 Data received: ", jobData)
+
+		//If the job's TTR expired whilst it was being processed, another worker may have
+		//reserved it and will process it again.
+		if err := jobMgr.TryDelete(); errors.Is(err, beanstalkworker.ErrJobNotFound) {
+			jobMgr.LogWarn("Job timed out before it was deleted, it may be processed twice")
+		}
+	}, beanstalkworker.WithConcurrency(4))
+
+	//Handlers for plain text or binary jobs can receive the body untouched.
+	bsWorker.Subscribe("logs", func(jobMgr beanstalkworker.JobManager, body []byte) error {
+		jobMgr.LogInfo("Log line: ", string(body))
+		return nil
+	})
+
+	//In-flight jobs are given 10s to finish once the context is cancelled,
+	//after that any job still reserved is released with zero delay.
+	bsWorker.SetDrainTimeout(10 * time.Second)
+
+	//Back off between reconnection attempts, giving up after 10 failures in a row.
+	bsWorker.SetReconnectPolicy(&beanstalkworker.ReconnectPolicy{
+		InitialDelay: time.Second,
+		Multiplier:   2,
+		MaxDelay:     time.Minute,
+		Jitter:       0.2,
+		MaxAttempts:  10,
+	})
+
+	bsWorker.OnDisconnect(func(addr string, err error) {
+		log.Printf("Disconnected from %s: %v", addr, err)
+	})
+
 	//Run the beanstalk worker, this blocks until the context is cancelled.
 	//It will also handle reconnecting to beanstalkd server automatically.
-	bsWorker.Run(ctx)
+	//Run returns ctx.Err() once stopped, so any other error is a misconfiguration
+	//or the server being unreachable.
+	if err := bsWorker.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		log.Print(err)
+	}
+
+	report := bsWorker.ShutdownReport()
+	log.Printf("Drained %d jobs, released %d jobs", report.Drained, report.Released)
+}
+
+func ExampleSubscribeFuncErr() {
+	bsWorker := beanstalkworker.NewWorker("127.0.0.1:11300")
+
+	//The job is deleted when the handler returns nil and released when it returns an error.
+	beanstalkworker.SubscribeFuncErr(bsWorker, "job1", func(jobMgr beanstalkworker.Job, jobData Job1Data) error {
+		if jobData.SomeField == "" {
+			//Wrapping the error with BuryJob or DeleteJob overrides the release.
+			return beanstalkworker.BuryJob(errors.New("someField is required"))
+		}
+
+		if jobData.SomeOtherField < 0 {
+			return errors.New("someOtherField is negative, try again later")
+		}
+
+		jobMgr.LogInfo("Processed job: ", jobData)
+		return nil
+	})
+
+	bsWorker.Run(context.Background())
+}
+
+func ExampleSubscribeFuncCtx() {
+	bsWorker := beanstalkworker.NewWorker("127.0.0.1:11300")
+
+	//The context is cancelled when the drain timeout expires after the worker is stopped,
+	//or when the job's TTR is about to expire.
+	beanstalkworker.SubscribeFuncCtx(bsWorker, "job1", func(ctx context.Context, jobMgr beanstalkworker.Job, jobData Job1Data) error {
+		id, _ := beanstalkworker.JobIDFromContext(ctx)
+		jobMgr.LogInfo("Processing job ", id)
+
+		select {
+		case <-time.After(2 * time.Second): //Simulate a slow API call.
+			return nil
+		case <-ctx.Done():
+			return ctx.Err() //Job is released to be retried.
+		}
+	})
+
+	bsWorker.Run(context.Background())
+}
+
+func ExampleRetryPolicy_Delay() {
+	retry := &beanstalkworker.RetryPolicy{
+		BaseDelay:  5 * time.Second,
+		Multiplier: 2,
+		MaxDelay:   time.Minute,
+	}
+
+	for releases := uint32(0); releases < 5; releases++ {
+		fmt.Println(retry.Delay(releases))
+	}
+	// Output:
+	// 5s
+	// 10s
+	// 20s
+	// 40s
+	// 1m0s
+}
+
+func ExampleNewSlogLogger() {
+	//Log to stdout, removing the time so that the output is predictable.
+	handler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+
+	//Job messages are logged with the job's details as structured attributes.
+	//Use bsWorker.SetLogger(beanstalkworker.NewSlogLogger(handler)) for a worker.
+	job := beanstalkworker.NewEmptyJob(beanstalkworker.NewSlogLogger(handler))
+	job.LogInfo("Processing job")
+	// Output:
+	// level=INFO msg="Processing job" tube="" job_id=0 priority=0 reserves=0 age=0s worker=0
+}
+
+func ExampleStrictJSONCodec() {
+	var jobData Job1Data
+	codec := beanstalkworker.StrictJSONCodec{}
+
+	//Use bsWorker.SetCodec(codec) or the WithCodec(codec) subscribe option
+	//to decode job bodies with a different codec.
+	err := codec.Decode([]byte(`{"someField":"value","unknownField":1}`), &jobData)
+	fmt.Println(err)
+	// Output:
+	// json: unknown field "unknownField"
 }
 
 //signalHandler catches OS signals for program to end.
@@ -91,7 +266,7 @@ func (l *MyLogger) Errorf(format string, v ...interface{}) {
 
 // Job1Handler contains the business logic to handle the Job1 type jobs.
 type Job1Handler struct {
-	beanstalkworker.JobManager
+	beanstalkworker.Job
 	commonVar string
 }
 
@@ -101,10 +276,10 @@ type Job1Data struct {
 	SomeOtherField int    `json:"someOtherField"`
 }
 
-// LogError example of overriding a function provided in beanstalkworker.JobManager
+// LogError example of overriding a function provided in beanstalkworker.Job
 // and calling the underlying function in order to add context.
 func (handler *Job1Handler) LogError(a ...interface{}) {
-	handler.JobManager.LogError("Job1 error: ", fmt.Sprint(a...))
+	handler.Job.LogError("Job1 error: ", fmt.Sprint(a...))
 }
 
 // Run is executed by the beanstalk worker when a Job1 type job is received.
@@ -118,6 +293,8 @@ func (handler *Job1Handler) Run(jobData Job1Data) {
 	handler.LogInfo("Job Delay: ", handler.GetDelay())
 	handler.LogInfo("Job Timeouts: ", handler.GetTimeouts())
 	handler.LogInfo("Job Tube: ", handler.GetTube())
+	handler.LogInfo("Job Server: ", handler.GetServer())
+	handler.LogInfo("Job Correlation Id: ", handler.GetHeader(beanstalkworker.HeaderCorrelationID)) //Set if the job has an envelope.
 	// Retrieve the server's hostname where the job is running
 	conn := handler.GetConn()
 	stats, err := conn.Stats()
@@ -141,15 +318,11 @@ func (handler *Job1Handler) Run(jobData Job1Data) {
 		return
 	}
 
-	handler.SetReturnDelay(5 * time.Second) //Optional return delay (defaults to current delay)
-	handler.SetReturnPriority(5)            //Optional return priority (defaults to current priority)
-
-	if handler.GetReleases() >= 3 {
-		handler.Delete()
-		handler.LogError("Deleting job as too many releases")
-		return
-	}
+	handler.SetReturnDelay(5 * time.Second) //Optional return delay (defaults to current delay or retry policy)
+	handler.SetReturnPriority(5)            //Optional return priority (defaults to current priority or retry policy)
 
+	//Pretend job process failed and needs retrying, the retry policy dead-letters the job
+	//instead once it has been attempted too many times.
 	handler.LogInfo("Releasing job to be retried...")
-	handler.Release() //Pretend job process failed and needs retrying
+	handler.Release()
 }
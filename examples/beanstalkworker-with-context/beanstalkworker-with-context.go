@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"log"
 	"log/syslog"
@@ -74,6 +75,9 @@ func runWorker(ctx context.Context) {
 	// Set the number of concurrent workers
 	bsWorker.SetNumWorkers(*numWorkers)
 
+	// Keep long running import jobs reserved by touching them before their TTR expires
+	bsWorker.SetAutoTouch(true)
+
 	// Subscribe to jobs from our queue
 	bsWorker.Subscribe(importQueue, func(jobMgr beanstalkworker.JobManager, jobData ImportJobData) {
 		// Set up a new 'import' job handler, attaching the job manager and job data to it
@@ -89,5 +93,7 @@ func runWorker(ctx context.Context) {
 
 	// Run the worker, this call blocks until the context is cancelled
 	// The beanstalkworker package takes care of reconnecting to beanstalk automatically
-	bsWorker.Run(ctx)
+	if err := bsWorker.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		log.Print(err)
+	}
 }
@@ -0,0 +1,19 @@
+package beanstalkworker
+
+import "time"
+
+// AddMetric exposes Metrics.add to tests, allowing any label value to be recorded.
+func (m *Metrics) AddMetric(name string, label string, delta float64) {
+	m.add(name, label, delta)
+}
+
+// ObserveMetric exposes Metrics.observe to tests.
+func (m *Metrics) ObserveMetric(name string, label string, d time.Duration) {
+	m.observe(name, label, d)
+}
+
+// WrapEnvelope exposes wrapEnvelope to tests.
+var WrapEnvelope = wrapEnvelope
+
+// UnwrapEnvelope exposes unwrapEnvelope to tests.
+var UnwrapEnvelope = unwrapEnvelope
@@ -1,6 +1,7 @@
 package beanstalkworker
 
 import "time"
+import "context"
 import "github.com/beanstalkd/go-beanstalk"
 
 // JobManager interface represents a way to handle a job's lifecycle.
@@ -21,3 +22,34 @@ type JobManager interface {
 	SetReturnPriority(prio uint32)
 	SetReturnDelay(delay time.Duration)
 }
+
+// Job extends JobManager with the rest of what is known about a reserved job, and lifecycle
+// methods that return an error. It is passed to the handler functions added by SubscribeFunc,
+// SubscribeFuncErr and SubscribeFuncCtx, and to middleware. JobManager is left unchanged so
+// that existing implementations of it keep working.
+// TryDelete, TryTouch, TryRelease, TryBury and DeadLetter log any failure and return it as a
+// *JobError, which wraps ErrJobNotFound if the job is no longer reserved by the worker, for
+// example because its TTR expired, or ErrConnectionLost if the connection to the server was lost.
+type Job interface {
+	JobManager
+	TryDelete() error
+	TryTouch() error
+	TryRelease() error
+	Bury()
+	TryBury() error
+	DeadLetter() error
+	LogWarn(a ...interface{})
+	LogDebug(a ...interface{})
+	GetBuries() uint32
+	GetKicks() uint32
+	GetID() uint64
+	GetTTR() time.Duration
+	GetTimeLeft() time.Duration
+	GetState() string
+	GetFile() uint32
+	RefreshStats() error
+	GetBody() []byte
+	GetHeader(name string) string
+	GetServer() string
+	GetContext() context.Context
+}
@@ -1,6 +1,10 @@
 package beanstalkworker
 
-import "log"
+import (
+	"fmt"
+	"log"
+	"log/slog"
+)
 
 // CustomLogger provides support for the creation of custom logging.
 type CustomLogger interface {
@@ -10,20 +14,127 @@ type CustomLogger interface {
 	Errorf(format string, args ...interface{})
 }
 
+// LevelLogger is a CustomLogger that also supports debug and warning levels.
+// Custom loggers that don't implement it log debug messages as info and warnings as errors.
+type LevelLogger interface {
+	CustomLogger
+	Debug(v ...interface{})
+	Debugf(format string, args ...interface{})
+	Warn(v ...interface{})
+	Warnf(format string, args ...interface{})
+}
+
+// StructuredLogger is a CustomLogger backed by a log/slog Logger. When used, job log messages
+// are logged with structured attributes for the job's tube, id, priority, reserves, age and
+// the worker thread that received it, rather than prefixing the message.
+type StructuredLogger interface {
+	CustomLogger
+	Slog() *slog.Logger
+}
+
 // Logger provides support for standard logging.
 type Logger struct {
+	Debug  func(v ...interface{})
+	Debugf func(format string, v ...interface{})
 	Info   func(v ...interface{})
 	Infof  func(format string, v ...interface{})
+	Warn   func(v ...interface{})
+	Warnf  func(format string, v ...interface{})
 	Error  func(v ...interface{})
 	Errorf func(format string, v ...interface{})
+	slog   *slog.Logger
 }
 
 // NewDefaultLogger creates a new Logger initialised to use the global log package.
 func NewDefaultLogger() *Logger {
 	return &Logger{
+		Debug:  log.Print,
+		Debugf: log.Printf,
 		Info:   log.Print,
 		Infof:  log.Printf,
+		Warn:   log.Print,
+		Warnf:  log.Printf,
 		Error:  log.Print,
 		Errorf: log.Printf,
 	}
 }
+
+// setCustomLogger switches the logger to use a custom logger.
+func (l *Logger) setCustomLogger(cl CustomLogger) {
+	l.Info = cl.Info
+	l.Infof = cl.Infof
+	l.Error = cl.Error
+	l.Errorf = cl.Errorf
+
+	if ll, ok := cl.(LevelLogger); ok {
+		l.Debug = ll.Debug
+		l.Debugf = ll.Debugf
+		l.Warn = ll.Warn
+		l.Warnf = ll.Warnf
+	} else {
+		l.Debug = cl.Info
+		l.Debugf = cl.Infof
+		l.Warn = cl.Error
+		l.Warnf = cl.Errorf
+	}
+
+	l.slog = nil
+	if sl, ok := cl.(StructuredLogger); ok {
+		l.slog = sl.Slog()
+	}
+}
+
+// SlogLogger provides logging backed by a log/slog Handler. It implements StructuredLogger.
+type SlogLogger struct {
+	logger *slog.Logger
+}
+
+// NewSlogLogger creates a new SlogLogger that logs to the given slog Handler.
+func NewSlogLogger(h slog.Handler) *SlogLogger {
+	return &SlogLogger{logger: slog.New(h)}
+}
+
+// Slog returns the underlying slog Logger.
+func (l *SlogLogger) Slog() *slog.Logger {
+	return l.logger
+}
+
+// Debug logs a debug message.
+func (l *SlogLogger) Debug(v ...interface{}) {
+	l.logger.Debug(fmt.Sprint(v...))
+}
+
+// Debugf logs a formatted debug message.
+func (l *SlogLogger) Debugf(format string, v ...interface{}) {
+	l.logger.Debug(fmt.Sprintf(format, v...))
+}
+
+// Info logs an info message.
+func (l *SlogLogger) Info(v ...interface{}) {
+	l.logger.Info(fmt.Sprint(v...))
+}
+
+// Infof logs a formatted info message.
+func (l *SlogLogger) Infof(format string, v ...interface{}) {
+	l.logger.Info(fmt.Sprintf(format, v...))
+}
+
+// Warn logs a warning message.
+func (l *SlogLogger) Warn(v ...interface{}) {
+	l.logger.Warn(fmt.Sprint(v...))
+}
+
+// Warnf logs a formatted warning message.
+func (l *SlogLogger) Warnf(format string, v ...interface{}) {
+	l.logger.Warn(fmt.Sprintf(format, v...))
+}
+
+// Error logs an error message.
+func (l *SlogLogger) Error(v ...interface{}) {
+	l.logger.Error(fmt.Sprint(v...))
+}
+
+// Errorf logs a formatted error message.
+func (l *SlogLogger) Errorf(format string, v ...interface{}) {
+	l.logger.Error(fmt.Sprintf(format, v...))
+}
@@ -0,0 +1,268 @@
+package beanstalkworker
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the metrics collected by Metrics.
+const (
+	MetricJobsReserved     = "beanstalkworker_jobs_reserved_total"
+	MetricJobsDeleted      = "beanstalkworker_jobs_deleted_total"
+	MetricJobsReleased     = "beanstalkworker_jobs_released_total"
+	MetricJobsBuried       = "beanstalkworker_jobs_buried_total"
+	MetricJobsTouched      = "beanstalkworker_jobs_touched_total"
+	MetricJobsDeadLettered = "beanstalkworker_jobs_dead_lettered_total"
+	MetricDecodeErrors     = "beanstalkworker_decode_errors_total"
+	MetricHandlerPanics    = "beanstalkworker_handler_panics_total"
+	MetricJobsInFlight     = "beanstalkworker_jobs_in_flight"
+	MetricHandlerDuration  = "beanstalkworker_handler_duration_seconds"
+	MetricReconnects       = "beanstalkworker_reconnects_total"
+	MetricReserveTimeouts  = "beanstalkworker_reserve_timeouts_total"
+	MetricJobsPublished    = "beanstalkworker_jobs_published_total"
+	MetricPublishErrors    = "beanstalkworker_publish_errors_total"
+	MetricJobsSpooled      = "beanstalkworker_jobs_spooled_total"
+	MetricJobsForwarded    = "beanstalkworker_jobs_forwarded_total"
+	MetricSpoolDropped     = "beanstalkworker_spool_dropped_total"
+	MetricSpoolBytes       = "beanstalkworker_spool_bytes"
+)
+
+const (
+	metricTypeCounter       = "counter"
+	metricTypeGauge         = "gauge"
+	metricTypeHistogram     = "histogram"
+	metricLabelTube         = "tube"
+	metricLabelServer       = "server"
+	metricHistogramInfinity = "+Inf"
+	metricsContentType      = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// DefaultDurationBuckets are the upper bounds, in seconds, of the handler duration histogram buckets.
+var DefaultDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// metricDesc describes a metric family.
+type metricDesc struct {
+	help  string
+	typ   string
+	label string
+}
+
+// metricDescs describes all of the metric families in the order they are written.
+var metricDescs = []struct {
+	name string
+	metricDesc
+}{
+	{MetricJobsReserved, metricDesc{"Jobs reserved.", metricTypeCounter, metricLabelTube}},
+	{MetricJobsDeleted, metricDesc{"Jobs deleted, excluding those dead-lettered.", metricTypeCounter, metricLabelTube}},
+	{MetricJobsReleased, metricDesc{"Jobs released.", metricTypeCounter, metricLabelTube}},
+	{MetricJobsBuried, metricDesc{"Jobs buried.", metricTypeCounter, metricLabelTube}},
+	{MetricJobsTouched, metricDesc{"Jobs touched.", metricTypeCounter, metricLabelTube}},
+	{MetricJobsDeadLettered, metricDesc{"Jobs moved to a dead-letter tube.", metricTypeCounter, metricLabelTube}},
+	{MetricDecodeErrors, metricDesc{"Jobs whose body could not be decoded.", metricTypeCounter, metricLabelTube}},
+	{MetricHandlerPanics, metricDesc{"Panics recovered from handler functions.", metricTypeCounter, metricLabelTube}},
+	{MetricJobsInFlight, metricDesc{"Jobs currently being handled.", metricTypeGauge, metricLabelTube}},
+	{MetricHandlerDuration, metricDesc{"Time taken by handler functions.", metricTypeHistogram, metricLabelTube}},
+	{MetricReconnects, metricDesc{"Reconnections to the beanstalkd server.", metricTypeCounter, metricLabelServer}},
+	{MetricReserveTimeouts, metricDesc{"Reserve commands that timed out without a job.", metricTypeCounter, metricLabelServer}},
+	{MetricJobsPublished, metricDesc{"Jobs published.", metricTypeCounter, metricLabelTube}},
+	{MetricPublishErrors, metricDesc{"Jobs that could not be published.", metricTypeCounter, metricLabelTube}},
+	{MetricJobsSpooled, metricDesc{"Jobs stored in the spool whilst the server was unreachable.", metricTypeCounter, metricLabelTube}},
+	{MetricJobsForwarded, metricDesc{"Spooled jobs forwarded to the server.", metricTypeCounter, metricLabelTube}},
+	{MetricSpoolDropped, metricDesc{"Jobs that could not be stored in the spool or were dropped from it because they were corrupt.", metricTypeCounter, metricLabelTube}},
+	{MetricSpoolBytes, metricDesc{"Size of the jobs in the spool waiting to be forwarded.", metricTypeGauge, metricLabelServer}},
+}
+
+// histogram accumulates observations into cumulative buckets.
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Metrics collects counters, gauges and histograms about a worker and the jobs it processes.
+// It implements http.Handler, serving the metrics in the Prometheus text exposition format.
+// A nil *Metrics discards all metrics.
+type Metrics struct {
+	mu         sync.Mutex
+	buckets    []float64
+	values     map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+}
+
+// NewMetrics creates a new Metrics using DefaultDurationBuckets for the handler duration histogram.
+func NewMetrics() *Metrics {
+	return NewMetricsWithBuckets(DefaultDurationBuckets)
+}
+
+// NewMetricsWithBuckets creates a new Metrics using the given upper bounds, in seconds,
+// for the handler duration histogram buckets.
+func NewMetricsWithBuckets(buckets []float64) *Metrics {
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+
+	return &Metrics{
+		buckets:    sorted,
+		values:     make(map[string]map[string]float64),
+		histograms: make(map[string]map[string]*histogram),
+	}
+}
+
+// Value returns the current value of a counter or gauge for the given tube or server label.
+func (m *Metrics) Value(name string, label string) float64 {
+	if m == nil {
+		return 0
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.values[name][label]
+}
+
+// add adds delta to a counter or gauge.
+func (m *Metrics) add(name string, label string, delta float64) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	series, ok := m.values[name]
+	if !ok {
+		series = make(map[string]float64)
+		m.values[name] = series
+	}
+
+	series[label] += delta
+}
+
+// inc increments a counter.
+func (m *Metrics) inc(name string, label string) {
+	m.add(name, label, 1)
+}
+
+// observe records a duration in a histogram.
+func (m *Metrics) observe(name string, label string, d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	series, ok := m.histograms[name]
+	if !ok {
+		series = make(map[string]*histogram)
+		m.histograms[name] = series
+	}
+
+	h, ok := series[label]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.buckets))}
+		series[label] = h
+	}
+
+	seconds := d.Seconds()
+	for i, bound := range m.buckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+
+	h.count++
+	h.sum += seconds
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metricsContentType)
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics to out in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(out io.Writer) (int64, error) {
+	counter := &countingWriter{w: out}
+	bw := bufio.NewWriter(counter)
+
+	m.mu.Lock()
+	for _, desc := range metricDescs {
+		fmt.Fprintf(bw, "# HELP %s %s\n", desc.name, desc.help)
+		fmt.Fprintf(bw, "# TYPE %s %s\n", desc.name, desc.typ)
+
+		if desc.typ == metricTypeHistogram {
+			series := m.histograms[desc.name]
+			for _, label := range sortedKeys(series) {
+				h := series[label]
+				labels := desc.label + "=" + quoteLabel(label)
+				for i, bound := range m.buckets {
+					fmt.Fprintf(bw, "%s_bucket{%s,le=%q} %d\n", desc.name, labels, formatFloat(bound), h.counts[i])
+				}
+
+				fmt.Fprintf(bw, "%s_bucket{%s,le=%q} %d\n", desc.name, labels, metricHistogramInfinity, h.count)
+				fmt.Fprintf(bw, "%s_sum{%s} %s\n", desc.name, labels, formatFloat(h.sum))
+				fmt.Fprintf(bw, "%s_count{%s} %d\n", desc.name, labels, h.count)
+			}
+
+			continue
+		}
+
+		series := m.values[desc.name]
+		for _, label := range sortedKeys(series) {
+			fmt.Fprintf(bw, "%s{%s=%s} %s\n", desc.name, desc.label, quoteLabel(label), formatFloat(series[label]))
+		}
+	}
+	m.mu.Unlock()
+
+	err := bw.Flush()
+	return counter.n, err
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+// Write writes p to the underlying writer and counts the bytes written.
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// sortedKeys returns the keys of a map in order, so that the output is stable.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// labelEscaper escapes label values as required by the exposition format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quoteLabel returns a quoted and escaped label value.
+func quoteLabel(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+// formatFloat formats a sample value as required by the exposition format.
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return metricHistogramInfinity
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
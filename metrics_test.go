@@ -0,0 +1,136 @@
+package beanstalkworker_test
+
+import "github.com/tomponline/beanstalkworker"
+import "github.com/tomponline/beanstalkworker/beanstalktest"
+import "errors"
+import "bytes"
+import "testing"
+import "time"
+
+// metricsGolden is the expected output of TestMetricsWriteTo.
+const metricsGolden = `# HELP beanstalkworker_jobs_reserved_total Jobs reserved.
+# TYPE beanstalkworker_jobs_reserved_total counter
+beanstalkworker_jobs_reserved_total{tube="alpha"} 1
+beanstalkworker_jobs_reserved_total{tube="beta"} 2
+# HELP beanstalkworker_jobs_deleted_total Jobs deleted, excluding those dead-lettered.
+# TYPE beanstalkworker_jobs_deleted_total counter
+# HELP beanstalkworker_jobs_released_total Jobs released.
+# TYPE beanstalkworker_jobs_released_total counter
+# HELP beanstalkworker_jobs_buried_total Jobs buried.
+# TYPE beanstalkworker_jobs_buried_total counter
+# HELP beanstalkworker_jobs_touched_total Jobs touched.
+# TYPE beanstalkworker_jobs_touched_total counter
+# HELP beanstalkworker_jobs_dead_lettered_total Jobs moved to a dead-letter tube.
+# TYPE beanstalkworker_jobs_dead_lettered_total counter
+# HELP beanstalkworker_decode_errors_total Jobs whose body could not be decoded.
+# TYPE beanstalkworker_decode_errors_total counter
+# HELP beanstalkworker_handler_panics_total Panics recovered from handler functions.
+# TYPE beanstalkworker_handler_panics_total counter
+# HELP beanstalkworker_jobs_in_flight Jobs currently being handled.
+# TYPE beanstalkworker_jobs_in_flight gauge
+beanstalkworker_jobs_in_flight{tube="alpha"} 0
+# HELP beanstalkworker_handler_duration_seconds Time taken by handler functions.
+# TYPE beanstalkworker_handler_duration_seconds histogram
+beanstalkworker_handler_duration_seconds_bucket{tube="a\"b\\c\nd",le="0.5"} 1
+beanstalkworker_handler_duration_seconds_bucket{tube="a\"b\\c\nd",le="1"} 2
+beanstalkworker_handler_duration_seconds_bucket{tube="a\"b\\c\nd",le="+Inf"} 3
+beanstalkworker_handler_duration_seconds_sum{tube="a\"b\\c\nd"} 3
+beanstalkworker_handler_duration_seconds_count{tube="a\"b\\c\nd"} 3
+# HELP beanstalkworker_reconnects_total Reconnections to the beanstalkd server.
+# TYPE beanstalkworker_reconnects_total counter
+beanstalkworker_reconnects_total{server="host\"1\\"} 1
+# HELP beanstalkworker_reserve_timeouts_total Reserve commands that timed out without a job.
+# TYPE beanstalkworker_reserve_timeouts_total counter
+# HELP beanstalkworker_jobs_published_total Jobs published.
+# TYPE beanstalkworker_jobs_published_total counter
+# HELP beanstalkworker_publish_errors_total Jobs that could not be published.
+# TYPE beanstalkworker_publish_errors_total counter
+# HELP beanstalkworker_jobs_spooled_total Jobs stored in the spool whilst the server was unreachable.
+# TYPE beanstalkworker_jobs_spooled_total counter
+# HELP beanstalkworker_jobs_forwarded_total Spooled jobs forwarded to the server.
+# TYPE beanstalkworker_jobs_forwarded_total counter
+# HELP beanstalkworker_spool_dropped_total Jobs that could not be stored in the spool or were dropped from it because they were corrupt.
+# TYPE beanstalkworker_spool_dropped_total counter
+# HELP beanstalkworker_spool_bytes Size of the jobs in the spool waiting to be forwarded.
+# TYPE beanstalkworker_spool_bytes gauge
+beanstalkworker_spool_bytes{server="host:11300"} 1.5e+06
+`
+
+func TestMetricsWriteTo(t *testing.T) {
+	//Buckets are sorted, and label values are written in order and escaped.
+	metrics := beanstalkworker.NewMetricsWithBuckets([]float64{1, 0.5})
+	metrics.AddMetric(beanstalkworker.MetricJobsReserved, "beta", 2)
+	metrics.AddMetric(beanstalkworker.MetricJobsReserved, "alpha", 1)
+	metrics.AddMetric(beanstalkworker.MetricJobsInFlight, "alpha", 1)
+	metrics.AddMetric(beanstalkworker.MetricJobsInFlight, "alpha", -1)
+	metrics.AddMetric(beanstalkworker.MetricReconnects, `host"1\`, 1)
+	metrics.AddMetric(beanstalkworker.MetricSpoolBytes, "host:11300", 1500000)
+
+	//Observations are counted in every bucket they fit in, and above the largest bucket only in +Inf.
+	tube := "a\"b\\c\nd"
+	metrics.ObserveMetric(beanstalkworker.MetricHandlerDuration, tube, 250*time.Millisecond)
+	metrics.ObserveMetric(beanstalkworker.MetricHandlerDuration, tube, 750*time.Millisecond)
+	metrics.ObserveMetric(beanstalkworker.MetricHandlerDuration, tube, 2*time.Second)
+
+	var out bytes.Buffer
+	n, err := metrics.WriteTo(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := out.String(); got != metricsGolden {
+		t.Errorf("WriteTo wrote:\n%s\nwant:\n%s", got, metricsGolden)
+	}
+
+	if n != int64(out.Len()) {
+		t.Errorf("WriteTo returned %d bytes, wrote %d", n, out.Len())
+	}
+}
+
+func TestWorkerMetricsDisposal(t *testing.T) {
+	srv := beanstalktest.NewServer()
+	defer srv.Close()
+
+	metrics := beanstalkworker.NewMetrics()
+	w := beanstalkworker.NewWorker(srv.Addr)
+	w.SetMetrics(metrics)
+	w.Subscribe("ok", func(jobMgr beanstalkworker.JobManager, body []byte) error {
+		return nil
+	})
+
+	w.Subscribe("poison", func(jobMgr beanstalkworker.JobManager, body []byte) error {
+		return beanstalkworker.DeadLetterJob(errors.New("poison job"))
+	})
+
+	runWorker(t, w)
+
+	srv.Put("ok", []byte("job"), 0, 0, time.Minute)
+	srv.Put("poison", []byte("job"), 0, 0, time.Minute)
+
+	//Dead-lettered jobs are counted as dead-lettered but not also as deleted.
+	tests := []struct {
+		name string
+		tube string
+		want float64
+	}{
+		{beanstalkworker.MetricJobsDeleted, "ok", 1},
+		{beanstalkworker.MetricJobsDeadLettered, "ok", 0},
+		{beanstalkworker.MetricJobsDeleted, "poison", 0},
+		{beanstalkworker.MetricJobsDeadLettered, "poison", 1},
+	}
+
+	deadline := time.Now().Add(waitTimeout)
+	for metrics.Value(beanstalkworker.MetricJobsDeleted, "ok") < 1 || metrics.Value(beanstalkworker.MetricJobsDeadLettered, "poison") < 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("jobs not disposed of")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, test := range tests {
+		if got := metrics.Value(test.name, test.tube); got != test.want {
+			t.Errorf("%s{tube=%q} is %v, want %v", test.name, test.tube, got, test.want)
+		}
+	}
+}
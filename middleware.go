@@ -0,0 +1,39 @@
+package beanstalkworker
+
+import "context"
+
+// JobHandler handles a job. Returning an error has the job released, as described for SubscribeFuncErr.
+type JobHandler func(ctx context.Context, job Job) error
+
+// Middleware wraps a JobHandler to run code before and after the next handler in the chain.
+// The Job passed to the handler is the job's *RawJob, unless an earlier middleware has
+// wrapped it. A middleware can short-circuit the chain by not calling next, for example deleting
+// the job itself or returning DeleteJob to drop it.
+type Middleware func(next JobHandler) JobHandler
+
+// Use adds middleware that wraps the handler functions of all subscriptions.
+// Middleware is run in the order it is added, before any middleware added using WithMiddleware.
+func (w *Worker) Use(mw ...Middleware) {
+	w.middleware = append(w.middleware, mw...)
+}
+
+// WithMiddleware adds middleware that wraps the handler function of a subscription.
+func WithMiddleware(mw ...Middleware) SubscribeOption {
+	return func(sub *subscription) {
+		sub.middleware = append(sub.middleware, mw...)
+	}
+}
+
+// chainMiddleware wraps handler with the worker's and then the subscription's middleware,
+// so that the first middleware added is the outermost.
+func chainMiddleware(handler JobHandler, workerMw []Middleware, subMw []Middleware) JobHandler {
+	for i := len(subMw) - 1; i >= 0; i-- {
+		handler = subMw[i](handler)
+	}
+
+	for i := len(workerMw) - 1; i >= 0; i-- {
+		handler = workerMw[i](handler)
+	}
+
+	return handler
+}
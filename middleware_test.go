@@ -0,0 +1,89 @@
+package beanstalkworker_test
+
+import "github.com/tomponline/beanstalkworker"
+import "github.com/tomponline/beanstalkworker/beanstalktest"
+import "context"
+import "errors"
+import "reflect"
+import "sync"
+import "testing"
+import "time"
+
+func TestWorkerMiddlewareOrder(t *testing.T) {
+	srv := beanstalktest.NewServer()
+	defer srv.Close()
+
+	var mu sync.Mutex
+	var calls []string
+	record := func(call string) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, call)
+	}
+
+	//Middleware that records when it is entered and left.
+	named := func(name string) beanstalkworker.Middleware {
+		return func(next beanstalkworker.JobHandler) beanstalkworker.JobHandler {
+			return func(ctx context.Context, job beanstalkworker.Job) error {
+				record(name + " before")
+				err := next(ctx, job)
+				record(name + " after")
+				return err
+			}
+		}
+	}
+
+	w := beanstalkworker.NewWorker(srv.Addr)
+	w.Use(named("worker1"), named("worker2"))
+	beanstalkworker.SubscribeFuncErr(w, "jobs", func(jobMgr beanstalkworker.Job, data Job1Data) error {
+		record("handler")
+		return nil
+	}, beanstalkworker.WithMiddleware(named("sub1"), named("sub2")))
+
+	id := srv.Put("jobs", []byte("{}"), 0, 0, time.Minute)
+	runWorker(t, w)
+	srv.WaitForJobState(t, id, beanstalktest.StateDeleted, waitTimeout)
+
+	//Worker middleware runs before subscription middleware, and the first added is outermost.
+	want := []string{
+		"worker1 before", "worker2 before", "sub1 before", "sub2 before",
+		"handler",
+		"sub2 after", "sub1 after", "worker2 after", "worker1 after",
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls are %v, want %v", calls, want)
+	}
+}
+
+func TestWorkerMiddlewareShortCircuit(t *testing.T) {
+	srv := beanstalktest.NewServer()
+	defer srv.Close()
+
+	handled := make(chan struct{}, 1)
+
+	//The middleware drops the job without calling the handler.
+	drop := func(next beanstalkworker.JobHandler) beanstalkworker.JobHandler {
+		return func(ctx context.Context, job beanstalkworker.Job) error {
+			return beanstalkworker.DeleteJob(errors.New("unwanted"))
+		}
+	}
+
+	w := beanstalkworker.NewWorker(srv.Addr)
+	beanstalkworker.SubscribeFunc(w, "jobs", func(jobMgr beanstalkworker.Job, data Job1Data) {
+		handled <- struct{}{}
+		jobMgr.Release()
+	}, beanstalkworker.WithMiddleware(drop))
+
+	id := srv.Put("jobs", []byte("{}"), 0, 0, time.Minute)
+	runWorker(t, w)
+	srv.WaitForJobState(t, id, beanstalktest.StateDeleted, waitTimeout)
+
+	select {
+	case <-handled:
+		t.Error("handler called despite the middleware not calling next")
+	default:
+	}
+}
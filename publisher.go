@@ -0,0 +1,394 @@
+package beanstalkworker
+
+import (
+	"context"
+	"github.com/beanstalkd/go-beanstalk"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults used for jobs published without the corresponding PublishOption.
+const (
+	DefaultPriority uint32 = 1024
+	DefaultTTR             = 60 * time.Second
+)
+
+// Publisher represents a producer process that puts jobs into tubes on a beanstalkd server.
+// It connects to the server when the first job is published and automatically reconnects,
+// retrying the put, if it loses the connection. Jobs are encoded with the same codec and
+// envelope conventions that Subscribe expects. It is safe for concurrent use.
+type Publisher struct {
+	addr       string
+	mu         sync.Mutex
+	conn       *beanstalk.Conn
+	netConn    *trackedConn
+	log        *Logger
+	codec      Codec
+	envelope   bool
+	headers    map[string]string
+	retries    int
+	retryDelay time.Duration
+	batchMu    sync.Mutex
+	pipeline   *pipelineConn
+	stats      publisherCounters
+	metrics    *Metrics
+	spool      atomic.Pointer[spool]
+}
+
+// PublisherStats counts what a Publisher has done.
+type PublisherStats struct {
+	// Published is the number of jobs put successfully.
+	Published uint64
+
+	// Failed is the number of jobs that could not be put.
+	Failed uint64
+
+	// RoundTrips is the number of times a command was sent and its response waited for.
+	// A pipelined batch is a single round trip.
+	RoundTrips uint64
+
+	// Spooled is the number of jobs stored in the spool because beanstalkd was unreachable.
+	Spooled uint64
+
+	// Forwarded is the number of spooled jobs put successfully.
+	Forwarded uint64
+
+	// SpoolDropped is the number of jobs that could not be stored in the spool, or that were
+	// dropped from it because they were corrupt.
+	SpoolDropped uint64
+
+	// SpoolBytes is the size of the jobs in the spool waiting to be forwarded.
+	SpoolBytes int64
+}
+
+// publisherCounters accumulates the PublisherStats.
+type publisherCounters struct {
+	published    atomic.Uint64
+	failed       atomic.Uint64
+	roundTrips   atomic.Uint64
+	spooled      atomic.Uint64
+	forwarded    atomic.Uint64
+	spoolDropped atomic.Uint64
+}
+
+// publishOptions holds the options for publishing a single job.
+type publishOptions struct {
+	prio    uint32
+	delay   time.Duration
+	ttr     time.Duration
+	headers map[string]string
+}
+
+// PublishOption configures a single published job.
+type PublishOption func(*publishOptions)
+
+// WithPriority sets the priority of a published job. Defaults to DefaultPriority.
+func WithPriority(prio uint32) PublishOption {
+	return func(opts *publishOptions) {
+		opts.prio = prio
+	}
+}
+
+// WithDelay sets how long a published job is delayed before it is ready to be reserved.
+func WithDelay(delay time.Duration) PublishOption {
+	return func(opts *publishOptions) {
+		opts.delay = delay
+	}
+}
+
+// WithTTR sets the time to run of a published job. Defaults to DefaultTTR.
+func WithTTR(ttr time.Duration) PublishOption {
+	return func(opts *publishOptions) {
+		opts.ttr = ttr
+	}
+}
+
+// WithHeader sets a header on a published job, which is wrapped in an Envelope to carry it.
+func WithHeader(name string, value string) PublishOption {
+	return func(opts *publishOptions) {
+		if opts.headers == nil {
+			opts.headers = make(map[string]string)
+		}
+
+		opts.headers[http.CanonicalHeaderKey(name)] = value
+	}
+}
+
+// NewPublisher creates a new publisher, but does not actually connect to beanstalkd server yet.
+func NewPublisher(addr string) *Publisher {
+	return &Publisher{
+		addr:       addr,
+		log:        NewDefaultLogger(),
+		codec:      JSONCodec{},
+		headers:    make(map[string]string),
+		retries:    3,
+		retryDelay: time.Second,
+	}
+}
+
+// SetLogger switches logging to use a custom Logger.
+func (p *Publisher) SetLogger(cl CustomLogger) {
+	p.log.setCustomLogger(cl)
+}
+
+// SetCodec sets the codec used to encode job data. Defaults to JSONCodec.
+// Data that is a []byte is always published untouched.
+func (p *Publisher) SetCodec(codec Codec) {
+	p.codec = codec
+}
+
+// SetEnvelope sets whether all published jobs are wrapped in an Envelope, carrying their content
+// type, enqueue time and any headers. Jobs published with WithHeader are always wrapped.
+func (p *Publisher) SetEnvelope(enabled bool) {
+	p.envelope = enabled
+}
+
+// SetHeader sets a header on all published jobs, for example HeaderProducer.
+// Setting a header enables the envelope for all published jobs.
+func (p *Publisher) SetHeader(name string, value string) {
+	p.headers[http.CanonicalHeaderKey(name)] = value
+	p.envelope = true
+}
+
+// SetMetrics sets the Metrics that the publisher records published, failed and spooled jobs in.
+func (p *Publisher) SetMetrics(metrics *Metrics) {
+	p.metrics = metrics
+}
+
+// SetRetries sets how many times a put is retried, waiting delay in between,
+// if the connection to the beanstalkd server cannot be made. Defaults to 3 retries 1s apart.
+// A put is not retried if the connection is lost after it was sent, as the job may have been
+// put, so that it isn't put twice. A put over an idle connection that the server has closed,
+// for example when it was restarted, is always sent again once over a new connection.
+func (p *Publisher) SetRetries(retries int, delay time.Duration) {
+	p.retries = retries
+	p.retryDelay = delay
+}
+
+// Publish encodes data and puts it into tube, returning the new job's id.
+// The put is retried as set by SetRetries if the connection to the server cannot be made.
+// If a spool is set and the job is stored in it, rather than put, the returned id is 0.
+func (p *Publisher) Publish(ctx context.Context, tube string, data interface{}, opts ...PublishOption) (uint64, error) {
+	options := newPublishOptions(opts)
+
+	body, err := p.encode(data, options.headers)
+	if err != nil {
+		return 0, err
+	}
+
+	//Whilst the server is unreachable, spool jobs without trying it.
+	spool := p.spool.Load()
+	if spool != nil && spool.offline.Load() && spool.pending() > 0 {
+		return 0, p.spoolJob(spool, tube, body, options)
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		var id uint64
+		var sent bool
+		id, sent, err = p.put(tube, body, options)
+		if err == nil {
+			p.stats.published.Add(1)
+			p.metrics.inc(MetricJobsPublished, tube)
+			return id, nil
+		}
+
+		//The forwarder retries spooled jobs, so there is no need to wait for the server here.
+		if isConnectionError(err) && spool != nil {
+			p.log.Error("Error publishing job to ", tube, ", spooling: ", err)
+			spool.offline.Store(true)
+			return 0, p.spoolJob(spool, tube, body, options)
+		}
+
+		//Only retry if the put wasn't sent, otherwise the job may be put twice.
+		if !isConnectionError(err) || sent || attempt >= p.retries {
+			p.stats.failed.Add(1)
+			p.metrics.inc(MetricPublishErrors, tube)
+			return 0, err
+		}
+
+		p.log.Error("Error publishing job to ", tube, ", retrying: ", err)
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(p.retryDelay):
+		}
+	}
+}
+
+// Stats returns counts of what the publisher has done.
+func (p *Publisher) Stats() PublisherStats {
+	stats := PublisherStats{
+		Published:    p.stats.published.Load(),
+		Failed:       p.stats.failed.Load(),
+		RoundTrips:   p.stats.roundTrips.Load(),
+		Spooled:      p.stats.spooled.Load(),
+		Forwarded:    p.stats.forwarded.Load(),
+		SpoolDropped: p.stats.spoolDropped.Load(),
+	}
+
+	if spool := p.spool.Load(); spool != nil {
+		stats.SpoolBytes = spool.pending()
+	}
+
+	return stats
+}
+
+// Close closes the connections to the beanstalkd server, if it is connected, and the spool if set.
+// Jobs left in the spool are forwarded when a publisher next sets the same spool.
+func (p *Publisher) Close() error {
+	if spool := p.spool.Swap(nil); spool != nil {
+		if err := spool.close(); err != nil {
+			p.log.Error("Error closing spool: ", err)
+		}
+	}
+
+	p.batchMu.Lock()
+	p.closePipeline()
+	p.batchMu.Unlock()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn == nil {
+		return nil
+	}
+
+	err := p.conn.Close()
+	p.conn = nil
+	return err
+}
+
+// put puts a single encoded job, connecting to the beanstalkd server if needed, and reports whether
+// the put command was sent. The connection is dropped if it has been lost, so that the next put reconnects.
+// If a connection that was left idle fails before the server responds, it was most likely closed by the
+// server whilst idle, for example when it was restarted, so the put is sent again over a new connection.
+func (p *Publisher) put(tube string, body []byte, options publishOptions) (id uint64, sent bool, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	reused := p.conn != nil
+	id, sent, err = p.putOnce(tube, body, options)
+	if reused && err != nil && isConnectionError(err) && !p.netConn.responded() {
+		p.log.Error("Error publishing job to ", tube, " over idle connection, reconnecting: ", err)
+		id, sent, err = p.putOnce(tube, body, options)
+	}
+
+	return id, sent, err
+}
+
+// putOnce puts a single encoded job over the connection, connecting first if needed.
+func (p *Publisher) putOnce(tube string, body []byte, options publishOptions) (id uint64, sent bool, err error) {
+	if p.conn == nil {
+		dialer := &net.Dialer{Timeout: beanstalk.DefaultDialTimeout, KeepAlive: beanstalk.DefaultKeepAlivePeriod}
+		conn, err := dialer.Dial("tcp", p.addr)
+		if err != nil {
+			return 0, false, err
+		}
+
+		p.netConn = &trackedConn{Conn: conn}
+		p.conn = beanstalk.NewConn(p.netConn)
+	}
+
+	p.stats.roundTrips.Add(1)
+	p.netConn.reset()
+	id, err = beanstalk.NewTube(p.conn, tube).Put(body, options.prio, options.delay, options.ttr)
+	if err != nil && isConnectionError(err) {
+		p.conn.Close()
+		p.conn = nil
+	}
+
+	return id, !p.netConn.writeFailed, err
+}
+
+// trackedConn is a connection to the beanstalkd server that records whether a write to it failed,
+// in which case the command was not sent, and whether the server has responded to it.
+type trackedConn struct {
+	net.Conn
+	writeFailed bool
+	bytesRead   int
+}
+
+// Write writes p to the connection, recording whether it failed.
+func (c *trackedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if err != nil {
+		c.writeFailed = true
+	}
+
+	return n, err
+}
+
+// Read reads from the connection, counting the bytes read.
+func (c *trackedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.bytesRead += n
+	return n, err
+}
+
+// reset clears what has been recorded, before sending a command.
+func (c *trackedConn) reset() {
+	c.writeFailed = false
+	c.bytesRead = 0
+}
+
+// responded reports whether anything has been read from the server since the last reset.
+func (c *trackedConn) responded() bool {
+	return c.bytesRead > 0
+}
+
+// encode encodes data using the codec, wrapping it in an Envelope if enabled or there are job headers.
+func (p *Publisher) encode(data interface{}, jobHeaders map[string]string) ([]byte, error) {
+	var payload []byte
+	contentType := RawCodec{}.ContentType()
+	if body, ok := data.([]byte); ok {
+		payload = body
+	} else {
+		var err error
+		if payload, err = p.codec.Encode(data); err != nil {
+			return nil, err
+		}
+
+		contentType = p.codec.ContentType()
+	}
+
+	if !p.envelope && len(jobHeaders) == 0 {
+		return payload, nil
+	}
+
+	headers := map[string]string{
+		HeaderContentType: contentType,
+		HeaderEnqueuedAt:  time.Now().UTC().Format(time.RFC3339Nano),
+	}
+
+	for name, value := range p.headers {
+		headers[name] = value
+	}
+
+	for name, value := range jobHeaders {
+		headers[name] = value
+	}
+
+	return wrapEnvelope(headers, payload)
+}
+
+// newPublishOptions applies opts to the default publish options.
+func newPublishOptions(opts []PublishOption) publishOptions {
+	options := publishOptions{
+		prio: DefaultPriority,
+		ttr:  DefaultTTR,
+	}
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return options
+}
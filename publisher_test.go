@@ -0,0 +1,316 @@
+package beanstalkworker_test
+
+import "github.com/tomponline/beanstalkworker"
+import "github.com/tomponline/beanstalkworker/beanstalktest"
+import "github.com/beanstalkd/go-beanstalk"
+import "context"
+import "errors"
+import "net"
+import "os"
+import "sync"
+import "testing"
+import "time"
+
+// benchmarkAddr returns the address of the beanstalkd server to benchmark against,
+// starting a fake server if BEANSTALKD_ADDR is not set.
+func benchmarkAddr(b *testing.B) string {
+	addr := os.Getenv("BEANSTALKD_ADDR")
+	if addr == "" {
+		srv := beanstalktest.NewServer()
+		b.Cleanup(srv.Close)
+		addr = srv.Addr
+	}
+
+	return addr
+}
+
+func TestPublishBatch(t *testing.T) {
+	srv := beanstalktest.NewServer()
+	defer srv.Close()
+
+	publisher := beanstalkworker.NewPublisher(srv.Addr)
+	defer publisher.Close()
+
+	//Switch tubes within the batch and back again.
+	msgs := []beanstalkworker.Message{
+		{Tube: "tube1", Data: 1, Options: []beanstalkworker.PublishOption{beanstalkworker.WithPriority(10)}},
+		{Tube: "tube2", Data: 2, Options: []beanstalkworker.PublishOption{beanstalkworker.WithPriority(20)}},
+		{Tube: "tube2", Data: 3, Options: []beanstalkworker.PublishOption{beanstalkworker.WithPriority(30)}},
+		{Tube: "tube1", Data: 4, Options: []beanstalkworker.PublishOption{beanstalkworker.WithPriority(40)}},
+	}
+
+	results := publisher.PublishBatch(context.Background(), msgs)
+	if len(results) != len(msgs) {
+		t.Fatalf("Got %d results, want %d", len(results), len(msgs))
+	}
+
+	for i, result := range results {
+		if result.Err != nil {
+			t.Fatalf("Result %d: %v", i, result.Err)
+		}
+
+		job, ok := srv.Job(result.ID)
+		if !ok {
+			t.Fatalf("Result %d: job %d not found", i, result.ID)
+		}
+
+		if job.Tube != msgs[i].Tube || job.Priority != uint32((i+1)*10) {
+			t.Errorf("Result %d: job in tube %q with priority %d", i, job.Tube, job.Priority)
+		}
+	}
+
+	srv.AssertCounts(t, "tube1", beanstalktest.Counts{Ready: 2})
+	srv.AssertCounts(t, "tube2", beanstalktest.Counts{Ready: 2})
+
+	stats := publisher.Stats()
+	if stats.Published != 4 || stats.Failed != 0 || stats.RoundTrips != 1 {
+		t.Fatalf("Stats: %+v", stats)
+	}
+}
+
+func TestPublishBatchChunks(t *testing.T) {
+	srv := beanstalktest.NewServer()
+	defer srv.Close()
+
+	publisher := beanstalkworker.NewPublisher(srv.Addr)
+	defer publisher.Close()
+
+	msgs := make([]beanstalkworker.Message, 1100)
+	for i := range msgs {
+		msgs[i] = beanstalkworker.Message{Tube: "chunked", Data: i}
+	}
+
+	var lastID uint64
+	for i, result := range publisher.PublishBatch(context.Background(), msgs) {
+		if result.Err != nil {
+			t.Fatalf("Result %d: %v", i, result.Err)
+		}
+
+		if result.ID <= lastID {
+			t.Fatalf("Result %d: id %d not after %d", i, result.ID, lastID)
+		}
+
+		lastID = result.ID
+	}
+
+	srv.AssertCounts(t, "chunked", beanstalktest.Counts{Ready: len(msgs)})
+
+	//1100 jobs are put in chunks of 512, 512 and 76.
+	stats := publisher.Stats()
+	if stats.Published != uint64(len(msgs)) || stats.RoundTrips != 3 {
+		t.Fatalf("Stats: %+v", stats)
+	}
+}
+
+func TestAsyncPublisher(t *testing.T) {
+	srv := beanstalktest.NewServer()
+	defer srv.Close()
+
+	publisher := beanstalkworker.NewPublisher(srv.Addr)
+	defer publisher.Close()
+
+	var mu sync.Mutex
+	var failed []beanstalkworker.Message
+	onError := func(msg beanstalkworker.Message, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		failed = append(failed, msg)
+	}
+
+	//Flushes once the buffer is full.
+	bySize := publisher.NewAsync(3, time.Hour, onError)
+	defer bySize.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := bySize.Publish("size", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv.WaitForCounts(t, "size", beanstalktest.Counts{Ready: 3}, waitTimeout)
+
+	//Flushes at the interval, including the default interval.
+	byInterval := publisher.NewAsync(100, 10*time.Millisecond, onError)
+	defer byInterval.Close()
+
+	byDefault := publisher.NewAsync(100, 0, onError)
+	defer byDefault.Close()
+
+	byInterval.Publish("interval", 1)
+	byDefault.Publish("default-interval", 1)
+	srv.WaitForCounts(t, "interval", beanstalktest.Counts{Ready: 1}, waitTimeout)
+	srv.WaitForCounts(t, "default-interval", beanstalktest.Counts{Ready: 1}, waitTimeout)
+
+	//Close publishes the buffered jobs, reports failures and rejects any more jobs.
+	async := publisher.NewAsync(100, time.Hour, onError)
+	async.Publish("closed", 1)
+	async.Publish("bad tube", 2)
+	async.Publish("closed", 3)
+	async.Close()
+
+	srv.AssertCounts(t, "closed", beanstalktest.Counts{Ready: 2})
+
+	mu.Lock()
+	if len(failed) != 1 || failed[0].Tube != "bad tube" || failed[0].Data != 2 {
+		t.Errorf("Failed messages: %+v", failed)
+	}
+	mu.Unlock()
+
+	if err := async.Publish("closed", 4); err == nil {
+		t.Fatal("Publish after Close succeeded")
+	}
+
+	async.Close()
+}
+
+func TestPublishNotRetriedAfterSending(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	//A server that reads the put and then drops the connection without replying, so the
+	//job may or may not have been put.
+	conns := make(chan struct{}, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			conns <- struct{}{}
+			conn.Read(make([]byte, 1024))
+			conn.Close()
+		}
+	}()
+
+	publisher := beanstalkworker.NewPublisher(l.Addr().String())
+	defer publisher.Close()
+	publisher.SetRetries(3, time.Millisecond)
+
+	if _, err := publisher.Publish(context.Background(), "jobs", Job1Data{}); err == nil {
+		t.Fatal("Publish succeeded without a reply")
+	}
+
+	if len(conns) != 1 {
+		t.Fatalf("Publish connected %d times, want 1 as a sent put must not be retried", len(conns))
+	}
+
+	if stats := publisher.Stats(); stats.Failed != 1 || stats.RoundTrips != 1 {
+		t.Fatalf("Stats: %+v", stats)
+	}
+}
+
+func TestPublishAfterConnectionDropped(t *testing.T) {
+	srv := beanstalktest.NewServer()
+	defer srv.Close()
+
+	//Without retries, so that the dropped connections must be noticed before putting.
+	publisher := beanstalkworker.NewPublisher(srv.Addr)
+	defer publisher.Close()
+	publisher.SetRetries(0, 0)
+
+	ctx := context.Background()
+	msgs := []beanstalkworker.Message{{Tube: "jobs", Data: 1}}
+	if _, err := publisher.Publish(ctx, "jobs", Job1Data{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if result := publisher.PublishBatch(ctx, msgs)[0]; result.Err != nil {
+		t.Fatal(result.Err)
+	}
+
+	//The server drops its idle clients, as it does when it is restarted.
+	srv.WaitForConns(t, 2, waitTimeout)
+	srv.CloseClientConnections()
+	srv.WaitForConns(t, 0, waitTimeout)
+
+	if _, err := publisher.Publish(ctx, "jobs", Job1Data{}); err != nil {
+		t.Fatalf("Publish after the connection was dropped: %v", err)
+	}
+
+	if result := publisher.PublishBatch(ctx, msgs)[0]; result.Err != nil {
+		t.Fatalf("PublishBatch after the connection was dropped: %v", result.Err)
+	}
+
+	srv.AssertCounts(t, "jobs", beanstalktest.Counts{Ready: 4})
+	if stats := publisher.Stats(); stats.Published != 4 || stats.Failed != 0 {
+		t.Fatalf("Stats: %+v", stats)
+	}
+}
+
+func TestPublishBatchInvalidTube(t *testing.T) {
+	srv := beanstalktest.NewServer()
+	defer srv.Close()
+
+	publisher := beanstalkworker.NewPublisher(srv.Addr)
+	defer publisher.Close()
+
+	//A tube name containing CRLF must not be able to inject commands into the pipeline.
+	results := publisher.PublishBatch(context.Background(), []beanstalkworker.Message{
+		{Tube: "good", Data: 1},
+		{Tube: "bad tube", Data: 2},
+		{Tube: "bad\r\nput 0 0 60 1\r\nx", Data: 3},
+		{Tube: "", Data: 4},
+		{Tube: "good", Data: 5},
+	})
+
+	for i, want := range []error{nil, beanstalk.ErrBadChar, beanstalk.ErrBadChar, beanstalk.ErrEmpty, nil} {
+		if !errors.Is(results[i].Err, want) {
+			t.Errorf("Result %d: got error %v, want %v", i, results[i].Err, want)
+		}
+	}
+
+	srv.AssertCounts(t, "good", beanstalktest.Counts{Ready: 2})
+	srv.AssertCounts(t, "default", beanstalktest.Counts{})
+
+	stats := publisher.Stats()
+	if stats.Published != 2 || stats.Failed != 3 {
+		t.Fatalf("Stats: %+v", stats)
+	}
+}
+
+func BenchmarkPublish(b *testing.B) {
+	publisher := beanstalkworker.NewPublisher(benchmarkAddr(b))
+	defer publisher.Close()
+
+	ctx := context.Background()
+	jobData := Job1Data{SomeField: "value", SomeOtherField: 1}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := publisher.Publish(ctx, "benchmark", jobData); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportMetric(float64(publisher.Stats().RoundTrips)/float64(b.N), "roundtrips/op")
+}
+
+func BenchmarkPublishBatch(b *testing.B) {
+	publisher := beanstalkworker.NewPublisher(benchmarkAddr(b))
+	defer publisher.Close()
+
+	ctx := context.Background()
+	msgs := make([]beanstalkworker.Message, 100)
+	for i := range msgs {
+		msgs[i] = beanstalkworker.Message{
+			Tube: "benchmark",
+			Data: Job1Data{SomeField: "value", SomeOtherField: i},
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i += len(msgs) {
+		for _, result := range publisher.PublishBatch(ctx, msgs) {
+			if result.Err != nil {
+				b.Fatal(result.Err)
+			}
+		}
+	}
+
+	b.ReportMetric(float64(publisher.Stats().RoundTrips)/float64(b.N), "roundtrips/op")
+}
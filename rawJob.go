@@ -1,14 +1,22 @@
 package beanstalkworker
 
 import "time"
+import "context"
 import "github.com/beanstalkd/go-beanstalk"
 import "fmt"
+import "errors"
+import "encoding/json"
+import "sync"
+import "log/slog"
+import "net/http"
+import "strconv"
 
 // Actions the user can choose in case of an unmarshal error.
 const (
-	ActionDeleteJob  = "delete"
-	ActionBuryJob    = "bury"
-	ActionReleaseJob = "release"
+	ActionDeleteJob     = "delete"
+	ActionBuryJob       = "bury"
+	ActionReleaseJob    = "release"
+	ActionDeadLetterJob = "deadletter"
 )
 
 // RawJob represents the raw job data that is returned by beanstalkd.
@@ -16,28 +24,43 @@ type RawJob struct {
 	id          uint64
 	err         error
 	body        *[]byte
+	payload     []byte
+	headers     map[string]string
 	conn        *beanstalk.Conn
+	server      string
+	worker      int
 	tube        string
+	state       string
 	prio        uint32
 	releases    uint32
 	reserves    uint32
 	timeouts    uint32
+	buries      uint32
+	kicks       uint32
+	file        uint32
 	delay       time.Duration
 	age         time.Duration
+	ttr         time.Duration
+	timeLeft    time.Duration
 	returnPrio  uint32
 	returnDelay time.Duration
 	log         *Logger
+	metrics     *Metrics
+	mu          sync.Mutex // Serialises commands on conn between the handler and auto-touch.
+	disposed    bool
+	retry       *RetryPolicy
+	deadLetter  string
+	codec       Codec
+	ctx         context.Context
+	lastErr     error
 }
 
 // NewEmptyJob initialises a new empty RawJob with a custom logger.
-// Useful for testing methods that log messages on the job.
+// Useful for testing methods that log messages on the job. It has no connection, so use
+// beanstalktest.MockJob to test handlers that delete, release or touch the job.
 func NewEmptyJob(cl CustomLogger) *RawJob {
-	logger := &Logger{
-		Info:   cl.Info,
-		Infof:  cl.Infof,
-		Error:  cl.Error,
-		Errorf: cl.Errorf,
-	}
+	logger := &Logger{}
+	logger.setCustomLogger(cl)
 
 	return &RawJob{
 		log: logger,
@@ -45,31 +68,155 @@ func NewEmptyJob(cl CustomLogger) *RawJob {
 }
 
 // Delete function deletes the job from the queue.
+// Any failure is logged, use TryDelete to also have it returned.
 func (job *RawJob) Delete() {
+	job.TryDelete()
+}
+
+// TryDelete deletes the job from the queue.
+// Returns a *JobError if the job could not be deleted.
+func (job *RawJob) TryDelete() error {
+	if err := job.delete(); err != nil {
+		return err
+	}
+
+	job.metrics.inc(MetricJobsDeleted, job.tube)
+	return nil
+}
+
+// delete deletes the job from the queue without counting it as deleted.
+func (job *RawJob) delete() error {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	job.disposed = true
 	if err := job.conn.Delete(job.id); err != nil {
-		job.log.Error("Could not delete job: " + err.Error())
+		job.LogError("Could not delete job: ", err)
+		return &JobError{Op: "delete", ID: job.id, Err: err}
 	}
+
+	return nil
 }
 
 // Touch function touches the job from the queue.
+// Any failure is logged, use TryTouch to also have it returned.
 func (job *RawJob) Touch() {
+	job.TryTouch()
+}
+
+// TryTouch touches the job, restarting its TTR.
+// Returns a *JobError if the job could not be touched.
+func (job *RawJob) TryTouch() error {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
 	if err := job.conn.Touch(job.id); err != nil {
-		job.log.Error("Could not touch job: " + err.Error())
+		job.LogError("Could not touch job: ", err)
+		return &JobError{Op: "touch", ID: job.id, Err: err}
 	}
+
+	job.metrics.inc(MetricJobsTouched, job.tube)
+	return nil
 }
 
 // Release function releases the job from the queue.
+// Any failure is logged, use TryRelease to also have it returned.
 func (job *RawJob) Release() {
+	job.TryRelease()
+}
+
+// TryRelease releases the job back to the ready queue using its return delay and priority.
+// If the job has a retry policy that has been exhausted then the policy's give up action
+// is taken instead. Returns a *JobError if the job could not be released.
+func (job *RawJob) TryRelease() error {
+	if job.retry.Exhausted(job.reserves) {
+		action := job.retry.giveUpAction()
+		job.LogError("Retry attempts exhausted after ", job.reserves, " reserves, "+action+"...")
+		return job.doAction(action)
+	}
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	job.disposed = true
 	if err := job.conn.Release(job.id, job.returnPrio, job.returnDelay); err != nil {
-		job.log.Error("Could not release job: " + err.Error())
+		job.LogError("Could not release job: ", err)
+		return &JobError{Op: "release", ID: job.id, Err: err}
 	}
+
+	job.metrics.inc(MetricJobsReleased, job.tube)
+	return nil
 }
 
 // Bury function buries the job from the queue.
+// Any failure is logged, use TryBury to also have it returned.
 func (job *RawJob) Bury() {
+	job.TryBury()
+}
+
+// TryBury buries the job using its return priority.
+// Returns a *JobError if the job could not be buried.
+func (job *RawJob) TryBury() error {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	job.disposed = true
 	if err := job.conn.Bury(job.id, job.returnPrio); err != nil {
-		job.log.Error("Could not bury job: " + err.Error())
+		job.LogError("Could not bury job: ", err)
+		return &JobError{Op: "bury", ID: job.id, Err: err}
 	}
+
+	job.metrics.inc(MetricJobsBuried, job.tube)
+	return nil
+}
+
+// DeadLetter puts the job into its dead-letter tube, wrapped in a DeadLetter envelope
+// recording where it came from and the last error, and then deletes the original job.
+// The job is counted by MetricJobsDeadLettered rather than MetricJobsDeleted.
+// If the job cannot be put into the dead-letter tube it is buried instead.
+// Returns a *JobError if the job could not be deleted or buried.
+func (job *RawJob) DeadLetter() error {
+	envelope := DeadLetter{
+		Tube:     job.tube,
+		ID:       job.id,
+		Releases: job.releases,
+		Reserves: job.reserves,
+		Timeouts: job.timeouts,
+		Time:     time.Now(),
+	}
+
+	if job.body != nil {
+		envelope.Body = *job.body
+	}
+
+	if job.lastErr != nil {
+		envelope.Error = job.lastErr.Error()
+	}
+
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		job.LogError("Could not encode dead-letter job: ", err, ", burying...")
+		return job.TryBury()
+	}
+
+	ttr := job.ttr
+	if ttr <= 0 {
+		ttr = 60 * time.Second
+	}
+
+	job.mu.Lock()
+	job.disposed = true
+	tube := beanstalk.NewTube(job.conn, deadLetterTubeName(job.deadLetter, job.tube))
+	_, err = tube.Put(body, job.prio, 0, ttr)
+	job.mu.Unlock()
+
+	if err != nil {
+		job.LogError("Could not dead-letter job: ", err, ", burying...")
+		return job.TryBury()
+	}
+
+	job.metrics.inc(MetricJobsDeadLettered, job.tube)
+	return job.delete()
 }
 
 // SetReturnPriority sets the return priority to use if a job is released or buried.
@@ -112,6 +259,110 @@ func (job *RawJob) GetTimeouts() uint32 {
 	return job.timeouts
 }
 
+// GetBuries gets the count of buries of the job.
+func (job *RawJob) GetBuries() uint32 {
+	return job.buries
+}
+
+// GetKicks gets the count of kicks of the job.
+func (job *RawJob) GetKicks() uint32 {
+	return job.kicks
+}
+
+// GetID returns the job's id.
+func (job *RawJob) GetID() uint64 {
+	return job.id
+}
+
+// GetTTR gets the time to run of the job.
+func (job *RawJob) GetTTR() time.Duration {
+	return job.ttr
+}
+
+// GetTimeLeft gets how long the job had left before its TTR expired when it was reserved,
+// or when RefreshStats was last called.
+func (job *RawJob) GetTimeLeft() time.Duration {
+	return job.timeLeft
+}
+
+// GetState gets the state of the job, which is "reserved" whilst it is being handled.
+func (job *RawJob) GetState() string {
+	return job.state
+}
+
+// GetFile gets the number of the binlog file containing the job, or 0 if the server has no binlog.
+func (job *RawJob) GetFile() uint32 {
+	return job.file
+}
+
+// RefreshStats looks up the job's stats again, updating the values returned by the getters,
+// for example to check how much of the TTR is left. Returns a *JobError if the stats could
+// not be looked up, which wraps ErrJobNotFound if the job no longer exists.
+func (job *RawJob) RefreshStats() error {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	stats, err := job.conn.StatsJob(job.id)
+	if err == nil {
+		err = job.applyStats(stats)
+	}
+
+	if err != nil {
+		job.LogError("Could not refresh job stats: ", err)
+		return &JobError{Op: "stats", ID: job.id, Err: err}
+	}
+
+	return nil
+}
+
+// applyStats converts the values from a stats-job response and caches them in the job.
+func (job *RawJob) applyStats(stats map[string]string) error {
+	durations := []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"age", &job.age},
+		{"delay", &job.delay},
+		{"ttr", &job.ttr},
+		{"time-left", &job.timeLeft},
+	}
+
+	for _, d := range durations {
+		seconds, err := strconv.Atoi(stats[d.name])
+		if err != nil {
+			return err
+		}
+
+		*d.value = time.Duration(seconds) * time.Second
+	}
+
+	counts := []struct {
+		name  string
+		value *uint32
+	}{
+		{"pri", &job.prio},
+		{"releases", &job.releases},
+		{"reserves", &job.reserves},
+		{"timeouts", &job.timeouts},
+		{"buries", &job.buries},
+		{"kicks", &job.kicks},
+		{"file", &job.file},
+	}
+
+	for _, c := range counts {
+		count, err := strconv.ParseUint(stats[c.name], 10, 32)
+		if err != nil {
+			return err
+		}
+
+		*c.value = uint32(count)
+	}
+
+	job.tube = stats["tube"]
+	job.state = stats["state"]
+	return nil
+}
+
 // GetTube returns the tube name we got this job from.
 func (job *RawJob) GetTube() string {
 	return job.tube
@@ -122,26 +373,158 @@ func (job *RawJob) GetConn() *beanstalk.Conn {
 	return job.conn
 }
 
+// GetBody returns the job's body as received from the beanstalkd server.
+func (job *RawJob) GetBody() []byte {
+	if job.body == nil {
+		return nil
+	}
+
+	return *job.body
+}
+
+// GetHeader returns the value of a header from the job's Envelope,
+// or an empty string if the header isn't set or the job isn't enveloped.
+func (job *RawJob) GetHeader(name string) string {
+	return job.headers[http.CanonicalHeaderKey(name)]
+}
+
+// GetServer returns the address of the beanstalkd server the job was received from.
+func (job *RawJob) GetServer() string {
+	return job.server
+}
+
+// GetContext returns the job's context, which is cancelled when the worker's drain timeout
+// expires after it is stopped or the job's TTR is about to expire. Returns context.Background() for jobs not received by a worker.
+func (job *RawJob) GetContext() context.Context {
+	if job.ctx == nil {
+		return context.Background()
+	}
+
+	return job.ctx
+}
+
 // LogError function logs an error message regarding the job.
 func (job *RawJob) LogError(a ...interface{}) {
+	if job.log.slog != nil {
+		job.logAttrs(slog.LevelError, a)
+		return
+	}
+
 	job.log.Error("Tube: ", job.tube, ", Job: ", job.id, ": Error: ", fmt.Sprint(a...))
 }
 
+// LogWarn function logs a warning message regarding the job.
+func (job *RawJob) LogWarn(a ...interface{}) {
+	if job.log.slog != nil {
+		job.logAttrs(slog.LevelWarn, a)
+		return
+	}
+
+	job.log.Warn("Tube: ", job.tube, ", Job: ", job.id, ": Warning: ", fmt.Sprint(a...))
+}
+
 // LogInfo function logs an info message regarding the job.
 func (job *RawJob) LogInfo(a ...interface{}) {
+	if job.log.slog != nil {
+		job.logAttrs(slog.LevelInfo, a)
+		return
+	}
+
 	job.log.Info("Tube: ", job.tube, ", Job: ", job.id, ": ", fmt.Sprint(a...))
 }
 
-// unmarshalErrorAction handles unmarshal error, depending on the user choice.
-func (job *RawJob) unmarshalErrorAction(unmarshalErrorAction string) {
-	switch unmarshalErrorAction {
+// LogDebug function logs a debug message regarding the job.
+func (job *RawJob) LogDebug(a ...interface{}) {
+	if job.log.slog != nil {
+		job.logAttrs(slog.LevelDebug, a)
+		return
+	}
+
+	job.log.Debug("Tube: ", job.tube, ", Job: ", job.id, ": Debug: ", fmt.Sprint(a...))
+}
+
+// logAttrs logs a message regarding the job to the structured logger,
+// with the job's details as attributes.
+func (job *RawJob) logAttrs(level slog.Level, a []interface{}) {
+	job.log.slog.LogAttrs(job.GetContext(), level, fmt.Sprint(a...),
+		slog.String("tube", job.tube),
+		slog.Uint64("job_id", job.id),
+		slog.Uint64("priority", uint64(job.prio)),
+		slog.Uint64("reserves", uint64(job.reserves)),
+		slog.Duration("age", job.age),
+		slog.Int("worker", job.worker),
+	)
+}
+
+// unwrapPayload sets the job's payload, unwrapping it and its headers if the body is an Envelope.
+func (job *RawJob) unwrapPayload() {
+	body := job.GetBody()
+	if headers, payload, ok := unwrapEnvelope(body); ok {
+		job.headers = headers
+		job.payload = payload
+		return
+	}
+
+	job.payload = body
+}
+
+// isDisposed reports whether the job has been deleted, released or buried.
+func (job *RawJob) isDisposed() bool {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	return job.disposed
+}
+
+// setRetryPolicy attaches a retry policy to the job and uses it to initialise the
+// return delay and priority. These can still be overridden by the handler function.
+func (job *RawJob) setRetryPolicy(retry *RetryPolicy) {
+	job.retry = retry
+	if retry == nil {
+		return
+	}
+
+	job.returnDelay = retry.Delay(job.releases)
+	job.returnPrio = retry.Priority(job.prio)
+}
+
+// doAction deletes, buries or releases the job depending on the action.
+func (job *RawJob) doAction(action string) error {
+	switch action {
 	case ActionDeleteJob:
-		job.Delete()
+		return job.TryDelete()
 	case ActionBuryJob:
-		job.Bury()
+		return job.TryBury()
+	case ActionDeadLetterJob:
+		return job.DeadLetter()
 	default:
 		// Release as the default option as this would be the safest option for the user.
 		// We don't want someone to have some jobs being deleted if they are not aware of it.
-		job.Release()
+		return job.TryRelease()
+	}
+}
+
+// handleResult disposes of the job based on the error returned by a handler function,
+// unless the handler has already deleted, released or buried the job itself.
+// A nil error deletes the job, an ActionError applies its action and any other error
+// releases the job using its return delay and priority.
+func (job *RawJob) handleResult(err error) {
+	if job.isDisposed() {
+		return
+	}
+
+	if err == nil {
+		job.Delete()
+		return
 	}
+
+	action := ActionReleaseJob
+	var actionErr *ActionError
+	if errors.As(err, &actionErr) {
+		action = actionErr.Action
+	}
+
+	job.lastErr = err
+	job.LogError("Handler returned error: ", err, ", "+action+"...")
+	job.doAction(action)
 }
@@ -0,0 +1,60 @@
+package beanstalkworker
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrReconnectAttemptsExhausted is returned by Run when a worker thread fails to connect to a
+// beanstalkd server ReconnectPolicy.MaxAttempts times in a row.
+var ErrReconnectAttemptsExhausted = errors.New("reconnect attempts exhausted")
+
+// DefaultReconnectPolicy is used by workers without a ReconnectPolicy set. It backs off from 1s
+// up to 30s with jitter, so that workers don't all reconnect in lockstep, and never gives up.
+var DefaultReconnectPolicy = ReconnectPolicy{
+	InitialDelay: time.Second,
+	Multiplier:   2,
+	MaxDelay:     30 * time.Second,
+	Jitter:       0.2,
+}
+
+// ReconnectPolicy defines how long a worker waits between attempts to connect to a beanstalkd
+// server, and when to give up.
+type ReconnectPolicy struct {
+	// InitialDelay is the delay after the first failed connection attempt.
+	InitialDelay time.Duration
+
+	// Multiplier is applied to the delay for every previous failed attempt.
+	// Values less than 1 are treated as 1, giving a constant delay.
+	Multiplier float64
+
+	// MaxDelay caps the delay. Zero means no cap.
+	MaxDelay time.Duration
+
+	// Jitter is the fraction (0 to 1) of the delay that is randomly removed, to prevent
+	// workers from reconnecting in lockstep.
+	Jitter float64
+
+	// MaxAttempts is the number of failed connection attempts in a row after which the
+	// worker gives up and Run returns an error. Zero means the worker never gives up.
+	MaxAttempts int
+}
+
+// Delay calculates the delay before the next connection attempt, after the given number of
+// failed attempts in a row.
+func (p *ReconnectPolicy) Delay(failures int) time.Duration {
+	return backoff(p.InitialDelay, p.Multiplier, p.MaxDelay, p.Jitter, max(failures-1, 0))
+}
+
+// Exhausted reports whether the worker should give up after the given number of failed
+// attempts in a row.
+func (p *ReconnectPolicy) Exhausted(failures int) bool {
+	return p.MaxAttempts > 0 && failures >= p.MaxAttempts
+}
+
+// ConnectHandler is called with the server address when a worker thread connects to it.
+type ConnectHandler func(addr string)
+
+// DisconnectHandler is called with the server address when a worker thread's connection to it
+// ends. err is the error that caused the disconnection, or nil if the worker was stopped.
+type DisconnectHandler func(addr string, err error)
@@ -0,0 +1,83 @@
+package beanstalkworker
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy defines how jobs are retried when they are released by a handler, either by
+// calling Release or by returning an error, and when to give up retrying them.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a job can be reserved before giving up.
+	// Zero means the job is retried forever.
+	MaxAttempts int
+
+	// BaseDelay is the release delay used for the first retry.
+	BaseDelay time.Duration
+
+	// Multiplier is applied to the delay for every previous release of the job.
+	// Values less than 1 are treated as 1, giving a constant delay.
+	Multiplier float64
+
+	// MaxDelay caps the release delay. Zero means no cap.
+	MaxDelay time.Duration
+
+	// Jitter is the fraction (0 to 1) of the delay that is randomly removed, to prevent
+	// failed jobs from being retried in lockstep.
+	Jitter float64
+
+	// PriorityStep is added to the job's priority each time it is released, so that jobs
+	// that keep failing become less urgent than fresh jobs.
+	PriorityStep uint32
+
+	// GiveUpAction is the action taken once MaxAttempts is reached.
+	// Either ActionDeleteJob, ActionDeadLetterJob or ActionBuryJob (the default).
+	GiveUpAction string
+}
+
+// Delay calculates the release delay for a job that has already been released the given
+// number of times.
+func (p *RetryPolicy) Delay(releases uint32) time.Duration {
+	return backoff(p.BaseDelay, p.Multiplier, p.MaxDelay, p.Jitter, int(releases))
+}
+
+// backoff calculates an exponential backoff delay of base multiplied by multiplier n times,
+// capped at maxDelay if set, with up to the jitter fraction of it randomly removed.
+func backoff(base time.Duration, multiplier float64, maxDelay time.Duration, jitter float64, n int) time.Duration {
+	delay := float64(base) * math.Pow(math.Max(multiplier, 1), float64(n))
+	if maxDelay > 0 && delay > float64(maxDelay) {
+		delay = float64(maxDelay)
+	}
+
+	if jitter > 0 {
+		delay -= delay * math.Min(jitter, 1) * rand.Float64()
+	}
+
+	return time.Duration(delay)
+}
+
+// Priority calculates the release priority for a job with the given priority.
+func (p *RetryPolicy) Priority(prio uint32) uint32 {
+	if prio > math.MaxUint32-p.PriorityStep {
+		return math.MaxUint32
+	}
+
+	return prio + p.PriorityStep
+}
+
+// Exhausted reports whether a job that has been reserved the given number of times
+// should not be retried again. A nil policy is never exhausted.
+func (p *RetryPolicy) Exhausted(reserves uint32) bool {
+	return p != nil && p.MaxAttempts > 0 && reserves >= uint32(p.MaxAttempts)
+}
+
+// giveUpAction returns the action to take on a job once the policy is exhausted.
+func (p *RetryPolicy) giveUpAction() string {
+	if p.GiveUpAction == ActionDeleteJob || p.GiveUpAction == ActionDeadLetterJob {
+		return p.GiveUpAction
+	}
+
+	// Releasing again would defeat the point of giving up, so bury by default.
+	return ActionBuryJob
+}
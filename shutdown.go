@@ -0,0 +1,122 @@
+package beanstalkworker
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultDrainTimeout is how long in-flight handlers are given to finish once the worker is stopped.
+const DefaultDrainTimeout = 30 * time.Second
+
+// ShutdownReport describes what happened to reserved jobs when the worker was stopped.
+type ShutdownReport struct {
+	// Drained is the number of in-flight jobs whose handlers finished within the drain timeout.
+	Drained int64
+
+	// Released is the number of reserved jobs released back to the ready queue with zero delay,
+	// either because they were reserved as the worker stopped or their handler did not finish
+	// within the drain timeout.
+	Released int64
+
+	// Abandoned is the number of reserved jobs that could not be released,
+	// these become ready again once their TTR expires.
+	Abandoned int64
+}
+
+// shutdownCounters accumulates the ShutdownReport from all worker threads.
+type shutdownCounters struct {
+	drained   atomic.Int64
+	released  atomic.Int64
+	abandoned atomic.Int64
+}
+
+// report returns the current values of the counters.
+func (c *shutdownCounters) report() ShutdownReport {
+	return ShutdownReport{
+		Drained:   c.drained.Load(),
+		Released:  c.released.Load(),
+		Abandoned: c.abandoned.Load(),
+	}
+}
+
+// newHandlerContext returns the context that job contexts are derived from. It carries the
+// values of ctx but is only cancelled once the drain timeout has expired after ctx is cancelled,
+// giving in-flight handlers a chance to finish.
+func (w *Worker) newHandlerContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	handlerCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() {
+		timer := time.AfterFunc(w.drainTimeout, cancel)
+		context.AfterFunc(handlerCtx, func() { timer.Stop() })
+	})
+
+	return handlerCtx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// runJob runs the handler for a job in its own goroutine, so that the worker can stop waiting
+// for it if it doesn't finish within the drain timeout once ctx is cancelled. In that case the
+// job is released and false is returned, as the handler may still be using the connection.
+func (w *Worker) runJob(ctx context.Context, handlerCtx context.Context, job *RawJob) bool {
+	w.metrics.inc(MetricJobsReserved, job.tube)
+	w.metrics.add(MetricJobsInFlight, job.tube, 1)
+	start := time.Now()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer w.metrics.add(MetricJobsInFlight, job.tube, -1)
+		defer func() { w.metrics.observe(MetricHandlerDuration, job.tube, time.Since(start)) }()
+		w.subHandler(handlerCtx, job)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+	}
+
+	select {
+	case <-done:
+		w.shutdown.drained.Add(1)
+		return true
+	case <-handlerCtx.Done():
+		job.LogError("Handler did not finish within drain timeout, releasing...")
+		w.releaseOnShutdown(job)
+		return false
+	}
+}
+
+// drainReserve waits for the outstanding reserve command to finish once the worker is stopped
+// and releases any job it reserved, so that the job isn't left reserved until its TTR expires.
+func (w *Worker) drainReserve(handlerCtx context.Context, jobCh chan *RawJob) {
+	select {
+	case job := <-jobCh:
+		if job.id != 0 {
+			w.releaseOnShutdown(job)
+		}
+	case <-handlerCtx.Done():
+	}
+}
+
+// releaseOnShutdown releases a reserved job with zero delay, unless it has been disposed of already.
+func (w *Worker) releaseOnShutdown(job *RawJob) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	if job.disposed {
+		return
+	}
+
+	job.disposed = true
+	if err := job.conn.Release(job.id, job.prio, 0); err != nil {
+		job.LogError("Could not release job on shutdown: ", err)
+		w.shutdown.abandoned.Add(1)
+		return
+	}
+
+	w.shutdown.released.Add(1)
+	job.metrics.inc(MetricJobsReleased, job.tube)
+}
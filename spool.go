@@ -0,0 +1,557 @@
+package beanstalkworker
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSpoolFull is returned when a job cannot be spooled because the spool has reached its maximum size.
+var ErrSpoolFull = errors.New("spool is full")
+
+// errSpoolCorrupt is returned when reading a record whose checksum or contents are invalid.
+var errSpoolCorrupt = errors.New("spool record is corrupt")
+
+// SpoolSync controls when writes to the spool are synced to disk.
+type SpoolSync int
+
+const (
+	// SpoolSyncAlways syncs the spool to disk after every write. This is the default.
+	SpoolSyncAlways SpoolSync = iota
+
+	// SpoolSyncInterval syncs the spool to disk at the SyncInterval.
+	SpoolSyncInterval
+
+	// SpoolSyncNever leaves syncing the spool to disk to the operating system.
+	SpoolSyncNever
+)
+
+// SpoolOptions configures the on-disk spool used by a Publisher when beanstalkd is unreachable.
+type SpoolOptions struct {
+	// Path of the spool file. The forwarding position is stored alongside it in Path + ".offset".
+	Path string
+
+	// Sync controls when writes are synced to disk.
+	Sync SpoolSync
+
+	// SyncInterval is how often the spool is synced when using SpoolSyncInterval. Defaults to 1s.
+	SyncInterval time.Duration
+
+	// MaxBytes is the maximum size of the jobs waiting to be forwarded. Zero means no limit.
+	MaxBytes int64
+
+	// RetryInterval is how often forwarding is retried whilst beanstalkd is unreachable. Defaults to 5s.
+	RetryInterval time.Duration
+}
+
+// spoolHeaderSize is the size of the length and checksum that precede each record.
+const spoolHeaderSize = 8
+
+// spoolCompactSize is how much of the spool file must have been forwarded before it is compacted,
+// once the forwarded records also make up most of the file.
+const spoolCompactSize = 1 << 20
+
+// spoolRecord is a job stored in the spool.
+type spoolRecord struct {
+	tube     string
+	body     []byte
+	prio     uint32
+	delay    time.Duration
+	ttr      time.Duration
+	spooled  time.Time
+	size     int64 // Size of the record in the spool, including its header.
+	nextRead int64 // Offset of the following record.
+}
+
+// spool is an append-only file of jobs waiting to be forwarded to beanstalkd in order.
+type spool struct {
+	mu         sync.Mutex
+	opts       SpoolOptions
+	file       *os.File
+	offsetFile *os.File
+	size       int64       // Size of the spool file.
+	offset     int64       // Offset of the next record to forward.
+	dirty      bool        // Whether there are writes that haven't been synced.
+	offline    atomic.Bool // Whether beanstalkd was unreachable when last tried.
+	notify     chan struct{}
+	stop       chan struct{}
+	done       sync.WaitGroup
+}
+
+// SetSpool enables storing jobs in an on-disk spool when the connection to beanstalkd fails,
+// rather than returning an error. Whilst beanstalkd is unreachable, new jobs are spooled without
+// trying the server. A background forwarder puts the spooled jobs in order once beanstalkd is
+// reachable again, and new jobs are then put directly, so they may be put before older spooled jobs.
+// Jobs are forwarded at least once, a job may be put twice if the process stops after putting it
+// but before recording that it was forwarded. Corrupt records are skipped and counted as dropped.
+// Any jobs left in the spool from a previous run are forwarded.
+func (p *Publisher) SetSpool(opts SpoolOptions) error {
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = time.Second
+	}
+
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = 5 * time.Second
+	}
+
+	s, torn, err := openSpool(opts)
+	if err != nil {
+		return err
+	}
+
+	if torn > 0 {
+		p.log.Error("Discarded incomplete record of ", torn, " bytes at the end of spool ", opts.Path)
+		p.stats.spoolDropped.Add(1)
+		p.metrics.inc(MetricSpoolDropped, "")
+	}
+
+	p.spool.Store(s)
+	p.metrics.add(MetricSpoolBytes, p.addr, float64(s.pending()))
+
+	s.done.Add(1)
+	go p.forwardSpool(s)
+
+	if opts.Sync == SpoolSyncInterval {
+		s.done.Add(1)
+		go s.syncLoop()
+	}
+
+	return nil
+}
+
+// openSpool opens the spool file and its offset file, discarding any incomplete record at the end
+// left by the process stopping part way through a write. Returns the number of bytes discarded.
+func openSpool(opts SpoolOptions) (*spool, int64, error) {
+	file, err := os.OpenFile(opts.Path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	offsetFile, err := os.OpenFile(opts.Path+".offset", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	s := &spool{
+		opts:       opts,
+		file:       file,
+		offsetFile: offsetFile,
+		notify:     make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+	}
+
+	var buf [8]byte
+	if _, err := offsetFile.ReadAt(buf[:], 0); err == nil {
+		s.offset = int64(binary.BigEndian.Uint64(buf[:]))
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		s.close()
+		return nil, 0, err
+	}
+
+	s.size = info.Size()
+	if s.offset > s.size {
+		s.offset = 0
+	}
+
+	//Find the end of the last complete record, in case the process stopped part way through a write.
+	//Corrupt records are left for the forwarder to skip.
+	end := s.offset
+	for end < s.size {
+		record, err := s.read(end, s.size)
+		if err != nil && !errors.Is(err, errSpoolCorrupt) {
+			break
+		}
+
+		end = record.nextRead
+	}
+
+	torn := s.size - end
+	if torn > 0 {
+		if err := file.Truncate(end); err != nil {
+			s.close()
+			return nil, 0, err
+		}
+
+		s.size = end
+	}
+
+	return s, torn, nil
+}
+
+// spoolJob stores an encoded job in the spool to be forwarded later.
+func (p *Publisher) spoolJob(s *spool, tube string, body []byte, options publishOptions) error {
+	size, err := s.append(tube, body, options)
+	if err != nil {
+		p.stats.spoolDropped.Add(1)
+		p.metrics.inc(MetricSpoolDropped, tube)
+		return err
+	}
+
+	p.stats.spooled.Add(1)
+	p.metrics.inc(MetricJobsSpooled, tube)
+	p.metrics.add(MetricSpoolBytes, p.addr, float64(size))
+	return nil
+}
+
+// pending returns the number of bytes of jobs waiting to be forwarded.
+func (s *spool) pending() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.size - s.offset
+}
+
+// append adds a job to the end of the spool, returning the size of the record.
+func (s *spool) append(tube string, body []byte, options publishOptions) (int64, error) {
+	rest := make([]byte, 0, 2+len(tube)+4+8+8+8+len(body))
+	rest = binary.BigEndian.AppendUint16(rest, uint16(len(tube)))
+	rest = append(rest, tube...)
+	rest = binary.BigEndian.AppendUint32(rest, options.prio)
+	rest = binary.BigEndian.AppendUint64(rest, uint64(options.delay))
+	rest = binary.BigEndian.AppendUint64(rest, uint64(options.ttr))
+	rest = binary.BigEndian.AppendUint64(rest, uint64(time.Now().UnixNano()))
+	rest = append(rest, body...)
+
+	record := make([]byte, spoolHeaderSize, spoolHeaderSize+len(rest))
+	binary.BigEndian.PutUint32(record[0:], uint32(len(rest)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(rest))
+	record = append(record, rest...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.opts.MaxBytes > 0 && s.size-s.offset+int64(len(record)) > s.opts.MaxBytes {
+		return 0, ErrSpoolFull
+	}
+
+	if _, err := s.file.Write(record); err != nil {
+		return 0, err
+	}
+
+	s.size += int64(len(record))
+	if err := s.synced(s.file); err != nil {
+		return 0, err
+	}
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+
+	return int64(len(record)), nil
+}
+
+// read reads the record at offset in a spool of size bytes. If the record is corrupt, the record is returned with only its
+// size set, so that it can be skipped, along with errSpoolCorrupt.
+func (s *spool) read(offset int64, size int64) (*spoolRecord, error) {
+	var header [spoolHeaderSize]byte
+	if _, err := s.file.ReadAt(header[:], offset); err != nil {
+		return nil, err
+	}
+
+	//Don't trust a length that runs past the end of the spool.
+	length := int64(binary.BigEndian.Uint32(header[0:]))
+	if offset+spoolHeaderSize+length > size {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	rest := make([]byte, length)
+	if _, err := s.file.ReadAt(rest, offset+spoolHeaderSize); err != nil {
+		return nil, err
+	}
+
+	record := &spoolRecord{size: spoolHeaderSize + int64(len(rest))}
+	record.nextRead = offset + record.size
+
+	if crc32.ChecksumIEEE(rest) != binary.BigEndian.Uint32(header[4:]) {
+		return record, fmt.Errorf("%w: checksum mismatch at offset %d", errSpoolCorrupt, offset)
+	}
+
+	if len(rest) < 2 {
+		return record, fmt.Errorf("%w: record too short at offset %d", errSpoolCorrupt, offset)
+	}
+
+	tubeLen := int(binary.BigEndian.Uint16(rest))
+	if len(rest) < 2+tubeLen+4+8+8+8 {
+		return record, fmt.Errorf("%w: record too short at offset %d", errSpoolCorrupt, offset)
+	}
+
+	rest = rest[2:]
+	record.tube = string(rest[:tubeLen])
+	rest = rest[tubeLen:]
+	record.prio = binary.BigEndian.Uint32(rest)
+	record.delay = time.Duration(binary.BigEndian.Uint64(rest[4:]))
+	record.ttr = time.Duration(binary.BigEndian.Uint64(rest[12:]))
+	record.spooled = time.Unix(0, int64(binary.BigEndian.Uint64(rest[20:])))
+	record.body = rest[28:]
+
+	return record, nil
+}
+
+// remaining returns a record covering all of the records waiting to be forwarded, used to skip
+// the rest of the spool.
+func (s *spool) remaining() *spoolRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return &spoolRecord{size: s.size - s.offset, nextRead: s.size}
+}
+
+// next returns the next record to forward, or nil if the spool is empty. If the record is corrupt,
+// it is returned along with errSpoolCorrupt so that it can be skipped.
+func (s *spool) next() (*spoolRecord, error) {
+	s.mu.Lock()
+	offset, size := s.offset, s.size
+	s.mu.Unlock()
+
+	if offset >= size {
+		return nil, nil
+	}
+
+	return s.read(offset, size)
+}
+
+// forwarded records that the records before offset have been forwarded. Once all records have been
+// forwarded the spool is truncated, and once most of it has been forwarded it is compacted, so that
+// it doesn't grow forever whilst new jobs keep being spooled.
+func (s *spool) forwarded(offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.offset = offset
+	if s.offset >= s.size {
+		if err := s.file.Truncate(0); err != nil {
+			return err
+		}
+
+		s.offset = 0
+		s.size = 0
+	}
+
+	if s.offset >= spoolCompactSize && s.offset >= s.size-s.offset {
+		return s.compact()
+	}
+
+	return s.writeOffset()
+}
+
+// writeOffset stores the offset of the next record to forward. Must be called with the mutex held.
+func (s *spool) writeOffset() error {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(s.offset))
+	if _, err := s.offsetFile.WriteAt(buf[:], 0); err != nil {
+		return err
+	}
+
+	return s.synced(s.offsetFile)
+}
+
+// compact replaces the spool file with one containing only the records waiting to be forwarded.
+// The offset is reset before the new file replaces the old one, so that if the process stops in
+// between the forwarded records are forwarded again rather than records being skipped.
+// Must be called with the mutex held.
+func (s *spool) compact() error {
+	tmpPath := s.opts.Path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	pending := s.size - s.offset
+	_, err = io.Copy(file, io.NewSectionReader(s.file, s.offset, pending))
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	s.offset = 0
+	if err := s.writeOffset(); err == nil {
+		err = s.offsetFile.Sync()
+	}
+
+	if err == nil {
+		err = os.Rename(tmpPath, s.opts.Path)
+	}
+
+	if err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	s.file.Close()
+	s.file = file
+	s.size = pending
+	return nil
+}
+
+// synced syncs a file to disk after a write if required by the sync option, otherwise marks
+// the spool as dirty. Must be called with the mutex held.
+func (s *spool) synced(file *os.File) error {
+	if s.opts.Sync == SpoolSyncAlways {
+		return file.Sync()
+	}
+
+	s.dirty = true
+	return nil
+}
+
+// syncLoop syncs the spool to disk at the sync interval.
+func (s *spool) syncLoop() {
+	defer s.done.Done()
+
+	ticker := time.NewTicker(s.opts.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.sync()
+		}
+	}
+}
+
+// sync syncs the spool to disk if there are unsynced writes.
+func (s *spool) sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.dirty {
+		return nil
+	}
+
+	s.dirty = false
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+
+	return s.offsetFile.Sync()
+}
+
+// close stops the background goroutines, syncs and closes the spool files.
+func (s *spool) close() error {
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+
+	s.done.Wait()
+
+	err := s.sync()
+
+	//Publish may still be appending to the spool it loaded before the publisher was closed.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if closeErr := s.offsetFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// forwardSpool puts spooled jobs in order until the spool is closed, waiting for the retry interval
+// whilst beanstalkd is unreachable. Jobs rejected by beanstalkd are logged and skipped, as are
+// corrupt records, which are counted as dropped.
+func (p *Publisher) forwardSpool(s *spool) {
+	defer s.done.Done()
+
+	for {
+		record, err := s.next()
+		if errors.Is(err, errSpoolCorrupt) {
+			p.log.Error("Error reading spool, dropping record: ", err)
+			p.stats.spoolDropped.Add(1)
+			p.metrics.inc(MetricSpoolDropped, "")
+			p.spoolForwarded(s, record)
+			continue
+		}
+
+		//A record that runs past the end of the spool has a corrupt length, so the records
+		//after it can't be found.
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			p.log.Error("Error reading spool, dropping the rest of it: ", err)
+			p.stats.spoolDropped.Add(1)
+			p.metrics.inc(MetricSpoolDropped, "")
+			p.spoolForwarded(s, s.remaining())
+			continue
+		}
+
+		if err != nil {
+			p.log.Error("Error reading spool: ", err)
+		}
+
+		if record == nil || err != nil {
+			select {
+			case <-s.stop:
+				return
+			case <-s.notify:
+			case <-time.After(s.opts.RetryInterval):
+			}
+
+			continue
+		}
+
+		//The delay started when the job was spooled.
+		delay := record.delay - time.Since(record.spooled)
+		if delay < 0 {
+			delay = 0
+		}
+
+		_, _, err = p.put(record.tube, record.body, publishOptions{prio: record.prio, delay: delay, ttr: record.ttr})
+		if err != nil && isConnectionError(err) {
+			s.offline.Store(true)
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(s.opts.RetryInterval):
+			}
+
+			continue
+		}
+
+		//The server is reachable again, so new jobs can be put directly.
+		s.offline.Store(false)
+
+		if err != nil {
+			p.log.Error("Error forwarding spooled job to ", record.tube, ", dropping: ", err)
+			p.stats.failed.Add(1)
+			p.metrics.inc(MetricPublishErrors, record.tube)
+		} else {
+			p.stats.forwarded.Add(1)
+			p.metrics.inc(MetricJobsForwarded, record.tube)
+		}
+
+		p.spoolForwarded(s, record)
+	}
+}
+
+// spoolForwarded moves the spool on past a record that has been forwarded or skipped.
+func (p *Publisher) spoolForwarded(s *spool, record *spoolRecord) {
+	if err := s.forwarded(record.nextRead); err != nil {
+		p.log.Error("Error updating spool: ", err)
+	}
+
+	p.metrics.add(MetricSpoolBytes, p.addr, -float64(record.size))
+}
@@ -0,0 +1,322 @@
+package beanstalkworker_test
+
+import "github.com/tomponline/beanstalkworker"
+import "github.com/tomponline/beanstalkworker/beanstalktest"
+import "bytes"
+import "context"
+import "errors"
+import "net"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+
+// unreachableAddr returns the address of a port that nothing is listening on.
+func unreachableAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestPublisherSpool(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.spool")
+	addr := unreachableAddr(t)
+	ctx := context.Background()
+
+	publisher := beanstalkworker.NewPublisher(addr)
+	err := publisher.SetSpool(beanstalkworker.SpoolOptions{Path: path, RetryInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		id, err := publisher.Publish(ctx, "spooled", Job1Data{SomeField: "value", SomeOtherField: i})
+		if err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+
+		if id != 0 {
+			t.Fatalf("Publish returned id %d for a spooled job, want 0", id)
+		}
+	}
+
+	stats := publisher.Stats()
+	if stats.Spooled != 3 || stats.Failed != 0 || stats.SpoolBytes <= 0 {
+		t.Fatalf("Stats after spooling: %+v", stats)
+	}
+
+	spoolBytes := stats.SpoolBytes
+	if err := publisher.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	//Spooled jobs survive the publisher being closed and a full spool rejects new jobs.
+	publisher = beanstalkworker.NewPublisher(addr)
+	defer publisher.Close()
+
+	err = publisher.SetSpool(beanstalkworker.SpoolOptions{Path: path, MaxBytes: spoolBytes, RetryInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := publisher.Stats().SpoolBytes; got != spoolBytes {
+		t.Fatalf("SpoolBytes after reopening = %d, want %d", got, spoolBytes)
+	}
+
+	if _, err := publisher.Publish(ctx, "spooled", Job1Data{}); !errors.Is(err, beanstalkworker.ErrSpoolFull) {
+		t.Fatalf("Publish to full spool: got %v, want ErrSpoolFull", err)
+	}
+
+	if stats := publisher.Stats(); stats.SpoolDropped != 1 {
+		t.Fatalf("SpoolDropped = %d, want 1", stats.SpoolDropped)
+	}
+}
+
+func TestPublisherSpoolForward(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.spool")
+	ctx := context.Background()
+
+	publisher := beanstalkworker.NewPublisher(unreachableAddr(t))
+	err := publisher.SetSpool(beanstalkworker.SpoolOptions{Path: path, RetryInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{"first", "second", "third"} {
+		if _, err := publisher.Publish(ctx, "spooled", []byte(body), beanstalkworker.WithPriority(10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	publisher.Close()
+
+	//A publisher connected to a server forwards the jobs left in the spool in order.
+	srv := beanstalktest.NewServer()
+	defer srv.Close()
+
+	publisher = beanstalkworker.NewPublisher(srv.Addr)
+	defer publisher.Close()
+
+	err = publisher.SetSpool(beanstalkworker.SpoolOptions{Path: path, RetryInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.WaitForCounts(t, "spooled", beanstalktest.Counts{Ready: 3}, 5*time.Second)
+
+	for i, job := range srv.Jobs("spooled") {
+		if want := []string{"first", "second", "third"}[i]; string(job.Body) != want || job.Priority != 10 {
+			t.Errorf("job %d is %q with priority %d, want %q with priority 10", i, job.Body, job.Priority, want)
+		}
+	}
+
+	//Once the spool is empty, jobs are put directly.
+	for deadline := time.Now().Add(5 * time.Second); publisher.Stats().SpoolBytes > 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("spool not emptied")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if id, err := publisher.Publish(ctx, "spooled", []byte("direct")); err != nil || id == 0 {
+		t.Fatalf("Publish returned %d, %v, want a job id", id, err)
+	}
+
+	if stats := publisher.Stats(); stats.Forwarded != 3 || stats.Published != 1 || stats.SpoolBytes != 0 {
+		t.Errorf("Stats after forwarding: %+v", stats)
+	}
+}
+
+// spoolJobs stores the bodies in the spool at path using a publisher that cannot reach beanstalkd.
+func spoolJobs(t *testing.T, path string, bodies ...[]byte) {
+	t.Helper()
+
+	publisher := beanstalkworker.NewPublisher(unreachableAddr(t))
+	defer publisher.Close()
+
+	err := publisher.SetSpool(beanstalkworker.SpoolOptions{Path: path, Sync: beanstalkworker.SpoolSyncNever, RetryInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range bodies {
+		if _, err := publisher.Publish(context.Background(), "spooled", body); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// waitForSpoolEmpty waits for the publisher to forward all of the jobs in its spool.
+func waitForSpoolEmpty(t *testing.T, publisher *beanstalkworker.Publisher) {
+	t.Helper()
+
+	for deadline := time.Now().Add(waitTimeout); publisher.Stats().SpoolBytes > 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("spool not emptied")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPublisherSpoolCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.spool")
+	spoolJobs(t, path, []byte("first"), []byte("second"), []byte("third"))
+
+	//Corrupt the body of the second job.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := bytes.Index(data, []byte("second"))
+	if i < 0 {
+		t.Fatal("second job not found in spool")
+	}
+
+	data[i] ^= 0xff
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := beanstalktest.NewServer()
+	defer srv.Close()
+
+	publisher := beanstalkworker.NewPublisher(srv.Addr)
+	defer publisher.Close()
+
+	err = publisher.SetSpool(beanstalkworker.SpoolOptions{Path: path, RetryInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//The corrupt job is skipped rather than stopping the jobs after it being forwarded.
+	waitForSpoolEmpty(t, publisher)
+
+	jobs := srv.Jobs("spooled")
+	if len(jobs) != 2 || string(jobs[0].Body) != "first" || string(jobs[1].Body) != "third" {
+		t.Fatalf("Forwarded jobs: %+v", jobs)
+	}
+
+	if stats := publisher.Stats(); stats.Forwarded != 2 || stats.SpoolDropped != 1 {
+		t.Fatalf("Stats: %+v", stats)
+	}
+}
+
+func TestPublisherSpoolTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.spool")
+	spoolJobs(t, path, []byte("first"), []byte("second"))
+
+	//Cut the last job short, as if the process stopped part way through writing it.
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := beanstalktest.NewServer()
+	defer srv.Close()
+
+	publisher := beanstalkworker.NewPublisher(srv.Addr)
+	defer publisher.Close()
+
+	err = publisher.SetSpool(beanstalkworker.SpoolOptions{Path: path, RetryInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForSpoolEmpty(t, publisher)
+
+	jobs := srv.Jobs("spooled")
+	if len(jobs) != 1 || string(jobs[0].Body) != "first" {
+		t.Fatalf("Forwarded jobs: %+v", jobs)
+	}
+
+	if stats := publisher.Stats(); stats.Forwarded != 1 || stats.SpoolDropped != 1 {
+		t.Fatalf("Stats: %+v", stats)
+	}
+}
+
+func TestPublisherSpoolCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.spool")
+
+	//Enough jobs that the spool is compacted part way through forwarding them.
+	bodies := make([][]byte, 20)
+	for i := range bodies {
+		bodies[i] = bytes.Repeat([]byte{byte('a' + i)}, beanstalktest.MaxJobSize-100)
+	}
+
+	spoolJobs(t, path, bodies...)
+
+	srv := beanstalktest.NewServer()
+	defer srv.Close()
+
+	publisher := beanstalkworker.NewPublisher(srv.Addr)
+	defer publisher.Close()
+
+	err := publisher.SetSpool(beanstalkworker.SpoolOptions{Path: path, RetryInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//New jobs are put directly whilst the spooled jobs are forwarded, as the server is reachable.
+	if id, err := publisher.Publish(context.Background(), "direct", []byte("direct")); err != nil || id == 0 {
+		t.Fatalf("Publish returned %d, %v, want a job id", id, err)
+	}
+
+	waitForSpoolEmpty(t, publisher)
+
+	jobs := srv.Jobs("spooled")
+	if len(jobs) != len(bodies) {
+		t.Fatalf("Forwarded %d jobs, want %d", len(jobs), len(bodies))
+	}
+
+	for i, job := range jobs {
+		if !bytes.Equal(job.Body, bodies[i]) {
+			t.Errorf("Job %d has the wrong body", i)
+		}
+	}
+
+	if stats := publisher.Stats(); stats.Forwarded != uint64(len(bodies)) || stats.SpoolDropped != 0 {
+		t.Fatalf("Stats: %+v", stats)
+	}
+
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("Compaction left temporary file: %v", err)
+	}
+}
+
+func TestPublisherSpoolCloseWhilstPublishing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.spool")
+	ctx := context.Background()
+
+	publisher := beanstalkworker.NewPublisher(unreachableAddr(t))
+	publisher.SetRetries(0, 0)
+	if err := publisher.SetSpool(beanstalkworker.SpoolOptions{Path: path, RetryInterval: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+
+	//Publishing whilst the publisher is closed must not race with the spool being removed.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			publisher.Publish(ctx, "spooled", Job1Data{SomeOtherField: i})
+			publisher.PublishBatch(ctx, []beanstalkworker.Message{{Tube: "spooled", Data: i}})
+			publisher.Stats()
+		}
+	}()
+
+	time.Sleep(time.Millisecond)
+	publisher.Close()
+	<-done
+}
@@ -2,179 +2,778 @@ package beanstalkworker
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/beanstalkd/go-beanstalk"
 	"reflect"
-	"strconv"
+	"runtime/debug"
 	"sync"
 	"time"
 )
 
+// DefaultReserveTimeout is how long each reserve command waits for a job.
+const DefaultReserveTimeout = 5 * time.Second
+
 // Handler provides an interface type for callback functions.
 type Handler interface{}
 
+// rawJobType is the type passed as the first argument to handler functions.
+var rawJobType = reflect.TypeOf((*RawJob)(nil))
+
+// contextType is the type handler functions may accept as their first argument to receive the job's context.
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// errorType is the type handler functions may return to have the job disposed of automatically.
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
 // Worker represents a single process that is connecting to beanstalkd
 // and is consuming jobs from one or more tubes.
 type Worker struct {
-	addr                 string
-	tubeSubs             map[string]func(*RawJob)
+	addrs                []string
+	tubeSubs             map[string]*subscription
 	numWorkers           int
 	wg                   sync.WaitGroup
 	log                  *Logger
 	unmarshalErrorAction string
+	retry                *RetryPolicy
+	deadLetterTube       string
+	panicAction          string
+	panicHandler         PanicHandler
+	autoTouch            bool
+	reserveTimeout       time.Duration
+	drainTimeout         time.Duration
+	shutdown             shutdownCounters
+	metrics              *Metrics
+	middleware           []Middleware
+	codec                Codec
+	reconnect            *ReconnectPolicy
+	onConnect            ConnectHandler
+	onDisconnect         DisconnectHandler
+	configErrs           []error
+}
+
+// PanicHandler is called with the job, the recovered value and the stack trace when a
+// handler function panics.
+type PanicHandler func(job Job, recovered interface{}, stack []byte)
+
+// subscription represents a handler function and its options for a tube.
+type subscription struct {
+	handler     subHandlerFunc
+	returnsErr  bool
+	middleware  []Middleware
+	codec       Codec
+	retry       *RetryPolicy
+	autoTouch   bool
+	concurrency int
+}
+
+// WithAutoTouch enables auto-touch for a subscription, see Worker.SetAutoTouch.
+func WithAutoTouch() SubscribeOption {
+	return func(sub *subscription) {
+		sub.autoTouch = true
+	}
+}
+
+// WithConcurrency gives a subscription its own worker threads, each with its own connection
+// to the beanstalkd server, so that at most n of its jobs are processed concurrently and it
+// isn't starved by jobs from other tubes. Subscriptions without this option share the worker
+// threads started by SetNumWorkers. If SetNumWorkers has been called, the subscription shares
+// those threads instead, with at most n of them reserving or processing its jobs at once.
+func WithConcurrency(n int) SubscribeOption {
+	return func(sub *subscription) {
+		sub.concurrency = n
+	}
+}
+
+// subHandlerFunc decodes a job and calls the handler function subscribed to its tube,
+// passing it jobMgr which may have been wrapped by middleware.
+type subHandlerFunc func(ctx context.Context, job *RawJob, jobMgr Job) error
+
+// WithCodec sets the codec used to decode job bodies for a subscription, overriding the worker's codec.
+func WithCodec(codec Codec) SubscribeOption {
+	return func(sub *subscription) {
+		sub.codec = codec
+	}
+}
+
+// SubscribeOption configures a single subscription.
+type SubscribeOption func(*subscription)
+
+// WithRetryPolicy sets the retry policy for a subscription, overriding the worker's retry policy.
+func WithRetryPolicy(retry *RetryPolicy) SubscribeOption {
+	return func(sub *subscription) {
+		sub.retry = retry
+	}
 }
 
 // NewWorker creates a new worker process,
 // but does not actually connect to beanstalkd server yet.
-func NewWorker(addr string) *Worker {
+// If more than one server address is given then jobs are consumed from all of the servers,
+// each server getting its own worker threads and reconnecting independently.
+func NewWorker(addrs ...string) *Worker {
 	return &Worker{
-		addr:                 addr,
-		tubeSubs:             make(map[string]func(*RawJob)),
+		addrs:                addrs,
+		tubeSubs:             make(map[string]*subscription),
 		log:                  NewDefaultLogger(),
 		unmarshalErrorAction: ActionReleaseJob, // It ensures the job is released to the queue by default for unmarshal error.
+		deadLetterTube:       DefaultDeadLetterTube,
+		panicAction:          ActionReleaseJob,
+		reserveTimeout:       DefaultReserveTimeout,
+		drainTimeout:         DefaultDrainTimeout,
+		codec:                JSONCodec{},
 	}
 }
 
-// SetNumWorkers sets the number of concurrent workers threads that should be started.
+// SetNumWorkers sets the number of concurrent workers threads that should be started per server.
 // Each thread establishes a separate connection to the beanstalkd server.
+// These threads watch all tubes subscribed to without WithConcurrency. When set, numWorkers is
+// also the ceiling for the number of jobs processed concurrently per server across all subscriptions,
+// as the threads watch every tube, only reserving from tubes below their WithConcurrency limit.
 func (w *Worker) SetNumWorkers(numWorkers int) {
 	w.numWorkers = numWorkers
 }
 
 // SetLogger switches logging to use a custom Logger.
+// If the logger implements LevelLogger its debug and warning levels are used, and if it
+// implements StructuredLogger (such as SlogLogger) job messages are logged with structured attributes.
 func (w *Worker) SetLogger(cl CustomLogger) {
-	w.log.Info = cl.Info
-	w.log.Infof = cl.Infof
-	w.log.Error = cl.Error
-	w.log.Errorf = cl.Errorf
+	w.log.setCustomLogger(cl)
 }
 
 // Subscribe adds a handler function to be run for jobs coming from a particular tube.
-func (w *Worker) Subscribe(tube string, cb Handler) {
-	w.tubeSubs[tube] = func(job *RawJob) {
-		jobVal := reflect.ValueOf(job)
-		cbFunc := reflect.ValueOf(cb)
-		cbType := reflect.TypeOf(cb)
-		if cbType.Kind() != reflect.Func {
-			panic("Handler needs to be a func")
+// The handler must be a func that accepts a JobManager, or Job, and a value that the job's
+// body will be decoded into by the codec, optionally preceded by a context.Context as described
+// for SubscribeFuncCtx. If the value is a []byte it is passed the job's payload untouched.
+// Alternatively the handler can be a func that only accepts the *RawJob, and reads its body
+// using GetBody. The signature is checked when Subscribe is called.
+// If the handler also returns an error the job is disposed of automatically, as described
+// for SubscribeFuncErr. SubscribeFunc, SubscribeFuncErr and SubscribeFuncCtx should be
+// preferred as they check the signature at compile time. An invalid handler is logged and
+// Run returns an error wrapping ErrInvalidHandler.
+func (w *Worker) Subscribe(tube string, cb Handler, opts ...SubscribeOption) {
+	cbFunc := reflect.ValueOf(cb)
+	if cbFunc.Kind() != reflect.Func {
+		w.invalidHandler(tube, "Handler needs to be a func")
+		return
+	}
+
+	cbType := cbFunc.Type()
+
+	takesCtx := cbType.NumIn() > 0 && cbType.In(0) == contextType
+	jobArg := 0
+	if takesCtx {
+		jobArg = 1
+	}
+
+	//Handlers that only accept the job don't have their body decoded.
+	takesData := cbType.NumIn() != jobArg+1
+	if (takesData && cbType.NumIn() != jobArg+2) || !rawJobType.AssignableTo(cbType.In(jobArg)) {
+		w.invalidHandler(tube, "Handler needs to accept an optional context.Context, a JobManager and a job data value, or a *RawJob")
+		return
+	}
+
+	returnsErr := cbType.NumOut() == 1 && cbType.Out(0) == errorType
+	if cbType.NumOut() > 0 && !returnsErr {
+		w.invalidHandler(tube, "Handler needs to return nothing or an error")
+		return
+	}
+
+	jobType := cbType.In(jobArg)
+
+	w.subscribe(tube, returnsErr, func(ctx context.Context, job *RawJob, jobMgr Job) error {
+		//Pass the Job from the middleware unless the handler needs the job itself.
+		jobVal := reflect.ValueOf(jobMgr)
+		if !jobVal.Type().AssignableTo(jobType) {
+			jobVal = reflect.ValueOf(job)
 		}
 
-		dataType := cbType.In(1)
-		dataPtr := reflect.New(dataType)
+		args := []reflect.Value{jobVal}
+		if takesCtx {
+			args = append([]reflect.Value{reflect.ValueOf(ctx)}, args...)
+		}
+
+		if takesData {
+			dataPtr := reflect.New(cbType.In(jobArg + 1))
+			if err := w.decodeJob(job, dataPtr.Interface()); err != nil {
+				return err
+			}
+
+			args = append(args, dataPtr.Elem())
+		}
 
-		if err := json.Unmarshal(*job.body, dataPtr.Interface()); err != nil {
-			job.LogError("Error decoding JSON for job: ", err, ", '", string(*job.body), "', "+w.unmarshalErrorAction+"...")
-			// Delete, Bury or Release (default behaviour) the job to the queue, depending on the user choice.
-			job.unmarshalErrorAction(w.unmarshalErrorAction)
-			return
+		out := cbFunc.Call(args)
+		if returnsErr {
+			err, _ := out[0].Interface().(error)
+			return err
 		}
 
-		cbFunc.Call([]reflect.Value{jobVal, reflect.Indirect(dataPtr)})
+		return nil
+	}, opts)
+}
+
+// invalidHandler records that the handler for tube has an invalid signature, so that Run fails.
+func (w *Worker) invalidHandler(tube string, reason string) {
+	w.log.Error("Invalid handler for tube ", tube, ": ", reason)
+	w.configErrs = append(w.configErrs, fmt.Errorf("%w for tube %s: %s", ErrInvalidHandler, tube, reason))
+}
+
+// SubscribeFunc adds a type-safe handler function to be run for jobs coming from a particular tube.
+// The job's body is unwrapped if it is an Envelope and decoded into a value of type T by the codec
+// before fn is called, unless T is []byte in which case fn is passed the payload untouched.
+// fn can accept the job as a JobManager, a Job or a *RawJob.
+func SubscribeFunc[T any, J JobManager](w *Worker, tube string, fn func(J, T), opts ...SubscribeOption) {
+	if !checkJobType[J](w, tube) {
+		return
+	}
+
+	w.subscribe(tube, false, func(ctx context.Context, job *RawJob, jobMgr Job) error {
+		var data T
+		if err := w.decodeJob(job, &data); err != nil {
+			return err
+		}
+
+		fn(jobAs[J](job, jobMgr), data)
+		return nil
+	}, opts)
+}
+
+// SubscribeFuncErr adds a type-safe handler function that returns an error to be run for jobs
+// coming from a particular tube. Once fn returns, the job is deleted if the error is nil,
+// otherwise it is released using its return delay and priority. Wrap the error with BuryJob
+// or DeleteJob to bury or delete the job instead. If fn has already deleted, released or
+// buried the job then nothing further is done.
+func SubscribeFuncErr[T any, J JobManager](w *Worker, tube string, fn func(J, T) error, opts ...SubscribeOption) {
+	if !checkJobType[J](w, tube) {
+		return
+	}
+
+	w.subscribe(tube, true, func(ctx context.Context, job *RawJob, jobMgr Job) error {
+		var data T
+		if err := w.decodeJob(job, &data); err != nil {
+			return err
+		}
+
+		return fn(jobAs[J](job, jobMgr), data)
+	}, opts)
+}
+
+// SubscribeFuncCtx is the same as SubscribeFuncErr, but fn is also passed the job's context.
+// The context is derived from the context passed to Run, and is cancelled once the drain
+// timeout has expired after the worker is stopped. Unless auto-touch is enabled, its deadline
+// leaves a margin of a quarter of the TTR (at least 1s) before the job's TTR expires. It carries
+// the job's tube and id, see TubeFromContext and JobIDFromContext.
+func SubscribeFuncCtx[T any, J JobManager](w *Worker, tube string, fn func(context.Context, J, T) error, opts ...SubscribeOption) {
+	if !checkJobType[J](w, tube) {
+		return
+	}
+
+	w.subscribe(tube, true, func(ctx context.Context, job *RawJob, jobMgr Job) error {
+		var data T
+		if err := w.decodeJob(job, &data); err != nil {
+			return err
+		}
+
+		return fn(ctx, jobAs[J](job, jobMgr), data)
+	}, opts)
+}
+
+// checkJobType checks that a *RawJob can be passed to handlers accepting a J, recording an invalid
+// handler for tube if not, for example if J is some other implementation of JobManager.
+func checkJobType[J JobManager](w *Worker, tube string) bool {
+	if _, ok := any((*RawJob)(nil)).(J); !ok {
+		w.invalidHandler(tube, fmt.Sprintf("Handler cannot accept a job as a %v", reflect.TypeOf((*J)(nil)).Elem()))
+		return false
+	}
+
+	return true
+}
+
+// jobAs returns the Job from the middleware as a J, or the job itself if the handler needs it.
+func jobAs[J JobManager](job *RawJob, jobMgr Job) J {
+	if j, ok := jobMgr.(J); ok {
+		return j
 	}
+
+	return any(job).(J)
+}
+
+// subscribe adds a subscription for a tube with the given options applied.
+// If returnsErr is true the job is disposed of automatically based on the error returned by
+// the handler, otherwise only a non-nil error returned by middleware disposes of the job.
+func (w *Worker) subscribe(tube string, returnsErr bool, handler subHandlerFunc, opts []SubscribeOption) {
+	sub := &subscription{
+		handler:    handler,
+		returnsErr: returnsErr,
+	}
+
+	for _, opt := range opts {
+		opt(sub)
+	}
+
+	w.tubeSubs[tube] = sub
+}
+
+// decodeJob decodes the job's payload into dataPtr using the job's codec. If this fails the job is deleted,
+// buried, dead-lettered or released (default behaviour) depending on the unmarshal error action and the
+// error is returned.
+func (w *Worker) decodeJob(job *RawJob, dataPtr interface{}) error {
+	//Raw body handlers skip decoding entirely.
+	if bodyPtr, ok := dataPtr.(*[]byte); ok {
+		*bodyPtr = job.payload
+		return nil
+	}
+
+	err := job.codec.Decode(job.payload, dataPtr)
+	if err != nil {
+		job.lastErr = err
+		job.metrics.inc(MetricDecodeErrors, job.tube)
+		job.LogError("Error decoding "+job.codec.ContentType()+" for job: ", err, ", '", string(*job.body), "', "+w.unmarshalErrorAction+"...")
+		job.doAction(w.unmarshalErrorAction)
+	}
+
+	return err
 }
 
 // Run starts one or more worker threads based on the numWorkers value.
 // If numWorkers is set to zero or less then 1 worker is started.
-func (w *Worker) Run(ctx context.Context) {
+// Once ctx is cancelled no more jobs are reserved and in-flight handlers are given until the
+// drain timeout to finish, after which any job still reserved is released with zero delay.
+// What happened to the reserved jobs is logged and available from ShutdownReport.
+//
+// The configuration is checked before anything is started, returning an error wrapping
+// ErrInvalidConfig if it is invalid. If a worker thread gives up connecting to its server because
+// of the ReconnectPolicy, all of the threads are stopped in the same way and an error wrapping
+// ErrReconnectAttemptsExhausted is returned. Otherwise ctx.Err() is returned once stopped.
+func (w *Worker) Run(ctx context.Context) error {
+	if err := w.validate(); err != nil {
+		w.log.Error("Invalid configuration, cannot proceed: ", err)
+		return err
+	}
+
+	ceiling := w.numWorkers
 	if w.numWorkers <= 0 {
 		w.numWorkers = 1
 	}
 
-	if len(w.tubeSubs) <= 0 {
-		w.log.Error("No job subscriptions defined, cannot proceed.")
-		return
+	//Stopping all threads when one gives up is done by cancelling runCtx.
+	runCtx, cancelRun := context.WithCancel(ctx)
+	defer cancelRun()
+
+	handlerCtx, cancelHandlers := w.newHandlerContext(runCtx)
+	defer cancelHandlers()
+
+	threads := make([]workerThread, 0)
+	for _, addr := range w.addrs {
+		//With a ceiling, each thread processes one job at a time from any tube with capacity.
+		if ceiling > 0 {
+			limits := newTubeLimits(w.tubeSubs)
+			tubes := make([]string, 0, len(w.tubeSubs))
+			for tube := range w.tubeSubs {
+				tubes = append(tubes, tube)
+			}
+
+			for i := 0; i < ceiling; i++ {
+				threads = append(threads, workerThread{addr: addr, tubes: tubes, limits: limits})
+			}
+
+			continue
+		}
+
+		sharedTubes := make([]string, 0, len(w.tubeSubs))
+		for tube, sub := range w.tubeSubs {
+			if sub.concurrency <= 0 {
+				sharedTubes = append(sharedTubes, tube)
+				continue
+			}
+
+			for i := 0; i < sub.concurrency; i++ {
+				threads = append(threads, workerThread{addr: addr, tubes: []string{tube}})
+			}
+		}
+
+		if len(sharedTubes) > 0 {
+			for i := 0; i < w.numWorkers; i++ {
+				threads = append(threads, workerThread{addr: addr, tubes: sharedTubes})
+			}
+		}
 	}
 
-	for i := 0; i < w.numWorkers; i++ {
+	errs := make(chan error, len(threads))
+	for i, thread := range threads {
+		thread.num = i + 1
 		w.wg.Add(1) //Increment wait group count to represent new worker.
-		go w.startWorker(ctx)
+		go func(thread workerThread) {
+			defer w.wg.Done()
+			if err := w.startWorker(runCtx, handlerCtx, thread); err != nil {
+				errs <- err
+				cancelRun()
+			}
+		}(thread)
 	}
 
 	w.wg.Wait() //Block here until all workers cleanly finish.
+	close(errs)
+
+	report := w.ShutdownReport()
+	w.log.Infof("Shutdown complete, %d jobs drained, %d released, %d abandoned", report.Drained, report.Released, report.Abandoned)
+
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	return ctx.Err()
+}
+
+// validate checks the worker's configuration, returning all of the problems found.
+func (w *Worker) validate() error {
+	errs := append([]error(nil), w.configErrs...)
+	if len(w.tubeSubs) <= 0 {
+		errs = append(errs, ErrNoSubscriptions)
+	}
+
+	if len(w.addrs) <= 0 {
+		errs = append(errs, ErrNoServers)
+	}
+
+	for _, addr := range w.addrs {
+		if addr == "" {
+			errs = append(errs, fmt.Errorf("%w: empty beanstalkd server address", ErrInvalidConfig))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// ShutdownReport returns what happened to reserved jobs when the worker was stopped.
+func (w *Worker) ShutdownReport() ShutdownReport {
+	return w.shutdown.report()
 }
 
-// SetUnmarshalErrorAction defines what to do if there is an unmarshal error.
+// SetUnmarshalErrorAction defines what to do if there is an unmarshal error,
+// that is if the codec fails to decode the job's body.
 func (w *Worker) SetUnmarshalErrorAction(action string) {
-	// If this action is different than Delete, Bury or Release, the last one will be chosen
-	// as the default action in case of an unmarshal error, via the method job.unmarshalErrorHandling.
-	if action != ActionDeleteJob && action != ActionBuryJob {
+	// If this action is different than Delete, Bury, DeadLetter or Release, the last one will be chosen
+	// as the default action in case of an unmarshal error, via the method job.doAction.
+	if action != ActionDeleteJob && action != ActionBuryJob && action != ActionDeadLetterJob {
 		w.unmarshalErrorAction = ActionReleaseJob // By safety only and to keep log message consistent with the action.
 		return
 	}
 	w.unmarshalErrorAction = action
 }
 
+// SetCodec sets the codec used to decode job bodies, unless the subscription has its own codec
+// set using WithCodec. Defaults to JSONCodec.
+func (w *Worker) SetCodec(codec Codec) {
+	w.codec = codec
+}
+
+// SetRetryPolicy sets the retry policy used for jobs released by handler functions,
+// unless the subscription has its own policy set using WithRetryPolicy.
+func (w *Worker) SetRetryPolicy(retry *RetryPolicy) {
+	w.retry = retry
+}
+
+// SetDeadLetterTube sets the name of the tube that jobs are moved to by ActionDeadLetterJob.
+// Any {tube} in the name is replaced with the tube the job came from. Defaults to "{tube}.dlq".
+func (w *Worker) SetDeadLetterTube(name string) {
+	w.deadLetterTube = name
+}
+
+// SetAutoTouch enables or disables auto-touch for all subscriptions.
+// When enabled, jobs are touched in the background shortly before their TTR expires
+// until the handler function returns or the job is deleted, released or buried.
+// This allows long running handlers to keep their job reserved without calling Touch.
+func (w *Worker) SetAutoTouch(enabled bool) {
+	w.autoTouch = enabled
+}
+
+// SetReserveTimeout sets how long each reserve command waits for a job. This limits how long
+// stopping the worker waits for an outstanding reserve. Defaults to DefaultReserveTimeout.
+func (w *Worker) SetReserveTimeout(timeout time.Duration) {
+	w.reserveTimeout = timeout
+}
+
+// SetDrainTimeout sets how long in-flight handlers are given to finish once the worker is
+// stopped before their jobs are released. Defaults to DefaultDrainTimeout.
+func (w *Worker) SetDrainTimeout(timeout time.Duration) {
+	w.drainTimeout = timeout
+}
+
+// SetMetrics sets where metrics about the worker and the jobs it processes are collected.
+// Metrics implements http.Handler so it can be used to expose them to Prometheus.
+func (w *Worker) SetMetrics(metrics *Metrics) {
+	w.metrics = metrics
+}
+
+// SetPanicAction defines what to do with a job if its handler function panics.
+// Defaults to ActionReleaseJob.
+func (w *Worker) SetPanicAction(action string) {
+	w.panicAction = action
+}
+
+// SetPanicHandler sets a function to be called when a handler function panics,
+// for example to report the panic to an error tracking service.
+func (w *Worker) SetPanicHandler(handler PanicHandler) {
+	w.panicHandler = handler
+}
+
+// SetReconnectPolicy sets how long worker threads wait between attempts to connect to a
+// beanstalkd server, and when to give up. Defaults to DefaultReconnectPolicy.
+func (w *Worker) SetReconnectPolicy(policy *ReconnectPolicy) {
+	w.reconnect = policy
+}
+
+// OnConnect sets a function to be called each time a worker thread connects to a beanstalkd server.
+// As each thread has its own connection, it is called once per thread.
+func (w *Worker) OnConnect(handler ConnectHandler) {
+	w.onConnect = handler
+}
+
+// OnDisconnect sets a function to be called each time a worker thread's connection to a beanstalkd
+// server ends, including when the worker is stopped.
+func (w *Worker) OnDisconnect(handler DisconnectHandler) {
+	w.onDisconnect = handler
+}
+
+// reconnectPolicy returns the reconnect policy to use.
+func (w *Worker) reconnectPolicy() *ReconnectPolicy {
+	if w.reconnect != nil {
+		return w.reconnect
+	}
+
+	return &DefaultReconnectPolicy
+}
+
+// workerThread describes a single worker thread started by Run.
+type workerThread struct {
+	num    int         // Number of the thread, used in log messages.
+	addr   string      // Address of the beanstalkd server to connect to.
+	tubes  []string    // Tubes to reserve jobs from.
+	limits *tubeLimits // Limits the number of jobs from each tube processed concurrently on the server.
+}
+
 // startWorker activates a single worker and attempts to maintain a connection to the beanstalkd server.
-func (w *Worker) startWorker(ctx context.Context) {
+// Jobs are reserved from the thread's tubes that are below their concurrency limit and handlers
+// are run with handlerCtx, which outlives ctx by the drain timeout. Returns an error if the reconnect policy
+// gives up connecting to the server.
+func (w *Worker) startWorker(ctx context.Context, handlerCtx context.Context, thread workerThread) error {
+	addr := thread.addr
+	policy := w.reconnectPolicy()
+
 	defer w.log.Info("Worker stopped!")
-	defer w.wg.Done()
 
+	failures := 0
+	reconnecting := false
 	for {
 		//Check the process hasn't been cancelled whilst we are connecting.
 		select {
 		case <-ctx.Done():
-			return
+			return nil
 		default:
 		}
 
-		conn, err := beanstalk.Dial("tcp", w.addr)
+		conn, err := beanstalk.Dial("tcp", addr)
 		if err != nil {
-			w.log.Error("Error connecting to beanstalkd: ", err)
-			time.Sleep(5 * time.Second)
+			failures++
+			reconnecting = true
+			if policy.Exhausted(failures) {
+				w.log.Error("Error connecting to beanstalkd ", addr, ", giving up: ", err)
+				return fmt.Errorf("%w: %s after %d attempts: %w", ErrReconnectAttemptsExhausted, addr, failures, err)
+			}
+
+			delay := policy.Delay(failures)
+			w.log.Error("Error connecting to beanstalkd ", addr, ", retrying in ", delay, ": ", err)
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(delay):
+			}
+
 			continue
 		}
 
-		defer conn.Close()
+		failures = 0
+		if reconnecting {
+			w.metrics.inc(MetricReconnects, addr)
+		}
+		reconnecting = true //Any further connection is a reconnection.
 
-		watchTubes := make([]string, 0, len(w.tubeSubs))
-		for tube := range w.tubeSubs {
-			watchTubes = append(watchTubes, tube)
+		if w.onConnect != nil {
+			w.onConnect(addr)
 		}
-		tubes := beanstalk.NewTubeSet(conn, watchTubes...)
-		w.log.Infof("Connected, watching %v for new jobs", watchTubes)
-		jobCh := make(chan *RawJob)
 
-	loop:
-		for {
-			go w.getNextJob(jobCh, tubes)
-			select {
-			case <-ctx.Done():
-				//Context has been cancelled, time to finish up.
-				return
-			case job := <-jobCh:
-				//Handle job from the beanstalkd server.
-				if job.err != nil {
-					if job.err.Error() == "reserve-with-timeout: timeout" {
-						continue
-					} else if job.err.Error() == "reserve-with-timeout: deadline soon" {
-						//Dont re-poll too often. This is important because otherwise we
-						//end up in a busy wait loop for 1s spinning up go routines.
-						time.Sleep(2 * time.Second)
-						continue
-					}
-
-					//Some other problem so restart connection to beanstalkd.
-					w.log.Error("Error getting job from tube: ", job.err)
-					break loop
+		w.log.Infof("Worker %d connected to %s, watching %v for new jobs", thread.num, addr, thread.tubes)
+		err = w.reserveJobs(ctx, handlerCtx, thread, conn)
+		conn.Close()
+
+		if w.onDisconnect != nil {
+			w.onDisconnect(addr, err)
+		}
+
+		if err == nil {
+			return nil
+		}
+
+		//Some problem with the connection, so reconnect in next loop iteration.
+		w.log.Error("Error getting job from tube: ", err)
+	}
+}
+
+// reserveJobs reserves and handles jobs over conn until the worker is stopped, returning nil,
+// or until reserving a job fails, returning the error.
+func (w *Worker) reserveJobs(ctx context.Context, handlerCtx context.Context, thread workerThread, conn *beanstalk.Conn) error {
+	limits := thread.limits
+	jobCh := make(chan *RawJob, 1)
+
+	for {
+		//Don't reserve any more jobs once the worker has been stopped.
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		//Only watch the tubes that can take another job, so that any job reserved can be processed straight away.
+		watched := limits.acquire(ctx, thread.tubes)
+		if watched == nil {
+			return nil
+		}
+
+		go w.getNextJob(jobCh, beanstalk.NewTubeSet(conn, watched...), thread)
+		select {
+		case <-ctx.Done():
+			//Context has been cancelled, stop reserving and release any job that is
+			//reserved by the outstanding reserve command.
+			w.drainReserve(handlerCtx, jobCh)
+			limits.release(watched...)
+			return nil
+		case job := <-jobCh:
+			//Handle job from the beanstalkd server.
+			if job.err != nil {
+				limits.release(watched...)
+				if job.err.Error() == "reserve-with-timeout: timeout" {
+					w.metrics.inc(MetricReserveTimeouts, thread.addr)
+					continue
+				} else if job.err.Error() == "reserve-with-timeout: deadline soon" {
+					//Dont re-poll too often. This is important because otherwise we
+					//end up in a busy wait loop for 1s spinning up go routines.
+					time.Sleep(2 * time.Second)
+					continue
 				}
 
-				w.subHandler(job)
+				return job.err
 			}
 
+			//Only the job's tube stays in use whilst the job is processed.
+			for _, tube := range watched {
+				if tube != job.tube {
+					limits.release(tube)
+				}
+			}
+
+			finished := w.runJob(ctx, handlerCtx, job)
+			limits.release(job.tube)
+			if !finished || ctx.Err() != nil {
+				//Either the handler is still running after the drain timeout, or it finished
+				//whilst draining, time to finish up.
+				return nil
+			}
+		}
+	}
+}
+
+// tubeLimits limits the number of a server's worker threads that can reserve or process jobs
+// from each tube at once. A nil *tubeLimits has no limits.
+type tubeLimits struct {
+	mu      sync.Mutex
+	limits  map[string]int // Concurrency of the tubes that have a limit.
+	inUse   map[string]int // Number of threads using each tube that has a limit.
+	changed chan struct{}  // Closed when tubes are released.
+}
+
+// newTubeLimits creates the limits for the subscriptions that have a concurrency set.
+func newTubeLimits(subs map[string]*subscription) *tubeLimits {
+	l := &tubeLimits{
+		limits:  make(map[string]int),
+		inUse:   make(map[string]int),
+		changed: make(chan struct{}),
+	}
+
+	for tube, sub := range subs {
+		if sub.concurrency > 0 {
+			l.limits[tube] = sub.concurrency
+		}
+	}
+
+	return l
+}
+
+// acquire returns those of tubes that are below their limit, counting them as in use until they
+// are released. If all of the tubes are at their limit it waits for one to be released.
+// Returns nil if ctx is cancelled whilst waiting.
+func (l *tubeLimits) acquire(ctx context.Context, tubes []string) []string {
+	if l == nil {
+		return tubes
+	}
+
+	for {
+		l.mu.Lock()
+		available := make([]string, 0, len(tubes))
+		for _, tube := range tubes {
+			limit, ok := l.limits[tube]
+			if !ok {
+				available = append(available, tube)
+			} else if l.inUse[tube] < limit {
+				l.inUse[tube]++
+				available = append(available, tube)
+			}
+		}
+
+		changed := l.changed
+		l.mu.Unlock()
+
+		if len(available) > 0 {
+			return available
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil
 		}
-		conn.Close() //We will reconnect in next loop iteration.
 	}
 }
 
+// release stops counting tubes acquired by acquire as in use.
+func (l *tubeLimits) release(tubes ...string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, tube := range tubes {
+		if _, ok := l.limits[tube]; ok {
+			l.inUse[tube]--
+		}
+	}
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
 // getNextJob retrieves the next job from the tubes being watched.
-func (w *Worker) getNextJob(jobCh chan *RawJob, tubes *beanstalk.TubeSet) {
-	id, body, err := tubes.Reserve(60 * time.Second)
+func (w *Worker) getNextJob(jobCh chan *RawJob, tubes *beanstalk.TubeSet, thread workerThread) {
+	id, body, err := tubes.Reserve(w.reserveTimeout)
 	job := &RawJob{
-		id:   id,
-		body: &body,
-		err:  err,
-		conn: tubes.Conn,
-		log:  w.log,
+		id:      id,
+		body:    &body,
+		err:     err,
+		conn:    tubes.Conn,
+		server:  thread.addr,
+		worker:  thread.num,
+		log:     w.log,
+		metrics: w.metrics,
 	}
 
 	if err != nil {
@@ -190,29 +789,13 @@ func (w *Worker) getNextJob(jobCh chan *RawJob, tubes *beanstalk.TubeSet) {
 		return
 	}
 
-	//Cache tube job was received from in the job.
-	job.tube = stats["tube"]
-
-	///Convert string age into time.Duration and cache in job.
-	age, err := strconv.Atoi(stats["age"])
-	if err != nil {
+	//Cache the stats in the job.
+	if err := job.applyStats(stats); err != nil {
 		job.err = err
 		jobCh <- job
 		return
 	}
 
-	job.age = time.Duration(age) * time.Second
-
-	///Convert string delay into time.Duration and cache in job.
-	delay, err := strconv.Atoi(stats["delay"])
-	if err != nil {
-		job.err = err
-		jobCh <- job
-		return
-	}
-
-	job.delay = time.Duration(delay) * time.Second
-
 	//Initialise the return delay as the current delay.
 	job.returnDelay = job.delay
 
@@ -224,55 +807,76 @@ func (w *Worker) getNextJob(jobCh chan *RawJob, tubes *beanstalk.TubeSet) {
 		job.returnDelay = 60 * time.Second
 	}
 
-	//Convert string priority into uint32 and cache in job.
-	prio, err := strconv.Atoi(stats["pri"])
-	if err != nil {
-		job.err = err
-		jobCh <- job
-		return
-	}
-	job.prio = uint32(prio)
-
 	//Initialise the return priority as the current priority.
 	job.returnPrio = job.prio
 
-	//Convert string releases into uint32 and cache in job.
-	releases, err := strconv.Atoi(stats["releases"])
-	if err != nil {
-		job.err = err
-		jobCh <- job
-		return
-	}
-	job.releases = uint32(releases)
-
-	//Convert string reserves into uint32 and cache in job.
-	reserves, err := strconv.Atoi(stats["reserves"])
-	if err != nil {
-		job.err = err
-		jobCh <- job
-		return
-	}
-	job.reserves = uint32(reserves)
-
-	//Convert string timeouts into uint32 and cache in job.
-	timeouts, err := strconv.Atoi(stats["timeouts"])
-	if err != nil {
-		job.err = err
-		jobCh <- job
-		return
-	}
-	job.timeouts = uint32(timeouts)
-
 	//Send the job to the receiver channel.
 	jobCh <- job
 }
 
 // subHandler finds and executes any subcriber function for a job.
-func (w *Worker) subHandler(job *RawJob) {
+func (w *Worker) subHandler(ctx context.Context, job *RawJob) {
+	defer w.recoverPanic(job)
+
 	tube := job.GetTube()
-	if cb, ok := w.tubeSubs[tube]; ok {
-		cb(job)
+	if sub, ok := w.tubeSubs[tube]; ok {
+		job.deadLetter = w.deadLetterTube
+		if sub.codec != nil {
+			job.codec = sub.codec
+		} else {
+			job.codec = w.codec
+		}
+
+		job.unwrapPayload()
+
+		if sub.retry != nil {
+			job.setRetryPolicy(sub.retry)
+		} else {
+			job.setRetryPolicy(w.retry)
+		}
+
+		autoTouch := w.autoTouch || sub.autoTouch
+		if autoTouch {
+			stopAutoTouch := job.startAutoTouch()
+			defer stopAutoTouch()
+		}
+
+		var cancel context.CancelFunc
+		job.ctx, cancel = newJobContext(ctx, job, autoTouch)
+		defer cancel()
+
+		handler := chainMiddleware(func(ctx context.Context, jobMgr Job) error {
+			return sub.handler(ctx, job, jobMgr)
+		}, w.middleware, sub.middleware)
+
+		err := handler(job.ctx, job)
+		if sub.returnsErr || err != nil {
+			job.handleResult(err)
+		}
 	} else {
 		panic("Should not get a job with no handler function")
 	}
 }
+
+// recoverPanic recovers from a panic whilst handling a job so that the worker and its
+// connection stay alive. The panic is logged with its stack trace and passed to the panic
+// handler, then the panic action is taken unless the job has already been disposed of.
+func (w *Worker) recoverPanic(job *RawJob) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+
+	stack := debug.Stack()
+	w.metrics.inc(MetricHandlerPanics, job.tube)
+	job.lastErr = fmt.Errorf("panic: %v", recovered)
+	job.LogError("Panic in handler: ", recovered, "\n", string(stack))
+
+	if w.panicHandler != nil {
+		w.panicHandler(job, recovered, stack)
+	}
+
+	if !job.isDisposed() {
+		job.doAction(w.panicAction)
+	}
+}
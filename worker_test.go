@@ -0,0 +1,788 @@
+package beanstalkworker_test
+
+import "github.com/tomponline/beanstalkworker"
+import "github.com/beanstalkd/go-beanstalk"
+import "github.com/tomponline/beanstalkworker/beanstalktest"
+import "bytes"
+import "context"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "log/slog"
+import "strings"
+import "sync"
+import "testing"
+import "time"
+
+// waitTimeout is how long tests wait for the worker to act on a job.
+const waitTimeout = 5 * time.Second
+
+// runWorker runs the worker against the server until the test finishes, then stops it and waits for Run to return.
+func runWorker(t *testing.T, w *beanstalkworker.Worker) {
+	t.Helper()
+
+	w.SetReserveTimeout(time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		if err := w.Run(ctx); !errors.Is(err, context.Canceled) {
+			t.Errorf("Run returned %v, want context.Canceled", err)
+		}
+
+		close(done)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(waitTimeout):
+			t.Error("worker did not stop")
+		}
+	})
+}
+
+func TestWorkerJobActions(t *testing.T) {
+	srv := beanstalktest.NewServer()
+	defer srv.Close()
+
+	w := beanstalkworker.NewWorker(srv.Addr)
+	beanstalkworker.SubscribeFuncErr(w, "ok", func(jobMgr beanstalkworker.Job, data Job1Data) error {
+		if data.SomeField != "value" {
+			return beanstalkworker.BuryJob(errors.New("unexpected data"))
+		}
+
+		return nil
+	})
+
+	beanstalkworker.SubscribeFuncErr(w, "bury", func(jobMgr beanstalkworker.Job, data Job1Data) error {
+		return beanstalkworker.BuryJob(errors.New("bad job"))
+	})
+
+	beanstalkworker.SubscribeFuncErr(w, "poison", func(jobMgr beanstalkworker.Job, data Job1Data) error {
+		return beanstalkworker.DeadLetterJob(errors.New("poison job"))
+	})
+
+	beanstalkworker.SubscribeFuncErr(w, "retry", func(jobMgr beanstalkworker.Job, data Job1Data) error {
+		return errors.New("temporary failure")
+	}, beanstalkworker.WithRetryPolicy(&beanstalkworker.RetryPolicy{MaxAttempts: 3}))
+
+	beanstalkworker.SubscribeFunc(w, "panic", func(jobMgr beanstalkworker.Job, data Job1Data) {
+		panic("handler panic")
+	})
+
+	w.SetPanicAction(beanstalkworker.ActionBuryJob)
+	w.SetUnmarshalErrorAction(beanstalkworker.ActionBuryJob)
+
+	runWorker(t, w)
+
+	publisher := beanstalkworker.NewPublisher(srv.Addr)
+	defer publisher.Close()
+
+	ctx := context.Background()
+	publish := func(tube string, data interface{}) uint64 {
+		t.Helper()
+
+		id, err := publisher.Publish(ctx, tube, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return id
+	}
+
+	jobData := Job1Data{SomeField: "value", SomeOtherField: 1}
+
+	t.Run("delete", func(t *testing.T) {
+		srv.WaitForJobState(t, publish("ok", jobData), beanstalktest.StateDeleted, waitTimeout)
+	})
+
+	t.Run("bury", func(t *testing.T) {
+		srv.WaitForJobState(t, publish("bury", jobData), beanstalktest.StateBuried, waitTimeout)
+	})
+
+	t.Run("unmarshal error", func(t *testing.T) {
+		srv.WaitForJobState(t, publish("ok", []byte("not json")), beanstalktest.StateBuried, waitTimeout)
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		srv.WaitForJobState(t, publish("panic", jobData), beanstalktest.StateBuried, waitTimeout)
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		id := publish("retry", jobData)
+		srv.WaitForJobState(t, id, beanstalktest.StateBuried, waitTimeout)
+
+		job, _ := srv.Job(id)
+		if job.Reserves != 3 || job.Releases != 2 {
+			t.Errorf("job reserved %d times and released %d times, want 3 and 2", job.Reserves, job.Releases)
+		}
+	})
+
+	t.Run("dead letter", func(t *testing.T) {
+		id := publish("poison", jobData)
+		srv.WaitForJobState(t, id, beanstalktest.StateDeleted, waitTimeout)
+		srv.WaitForCounts(t, "poison.dlq", beanstalktest.Counts{Ready: 1}, waitTimeout)
+
+		var deadLetter beanstalkworker.DeadLetter
+		if err := json.Unmarshal(srv.Jobs("poison.dlq")[0].Body, &deadLetter); err != nil {
+			t.Fatal(err)
+		}
+
+		if deadLetter.Tube != "poison" || deadLetter.ID != id || deadLetter.Error != "poison job" {
+			t.Errorf("dead letter is %+v", deadLetter)
+		}
+	})
+}
+
+func TestWorkerShutdownReleasesJobs(t *testing.T) {
+	srv := beanstalktest.NewServer()
+	defer srv.Close()
+
+	started := make(chan struct{})
+	block := make(chan struct{})
+	defer close(block)
+
+	//The handler ignores its context, so it is still running when the drain timeout expires.
+	w := beanstalkworker.NewWorker(srv.Addr)
+	w.SetDrainTimeout(100 * time.Millisecond)
+	beanstalkworker.SubscribeFuncErr(w, "slow", func(jobMgr beanstalkworker.Job, data Job1Data) error {
+		close(started)
+		<-block
+		return nil
+	})
+
+	id := srv.Put("slow", []byte(`{"someField":"value"}`), 10, 0, time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(waitTimeout):
+		t.Fatal("handler not started")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(waitTimeout):
+		t.Fatal("worker did not stop")
+	}
+
+	srv.AssertJobState(t, id, beanstalktest.StateReady)
+
+	if report := w.ShutdownReport(); report.Released != 1 {
+		t.Errorf("shutdown report is %+v, want 1 released", report)
+	}
+}
+
+func TestWorkerReconnect(t *testing.T) {
+	srv := beanstalktest.NewServer()
+	defer srv.Close()
+
+	connects := make(chan string, 10)
+	disconnects := make(chan error, 10)
+
+	w := beanstalkworker.NewWorker(srv.Addr)
+	w.SetReconnectPolicy(&beanstalkworker.ReconnectPolicy{InitialDelay: 10 * time.Millisecond})
+	w.OnConnect(func(addr string) { connects <- addr })
+	w.OnDisconnect(func(addr string, err error) { disconnects <- err })
+	beanstalkworker.SubscribeFunc(w, "jobs", func(jobMgr beanstalkworker.Job, data Job1Data) {
+		jobMgr.Delete()
+	})
+
+	runWorker(t, w)
+
+	waitFor := func(ch <-chan string) string {
+		t.Helper()
+
+		select {
+		case addr := <-ch:
+			return addr
+		case <-time.After(waitTimeout):
+			t.Fatal("timed out waiting for connection")
+			return ""
+		}
+	}
+
+	if addr := waitFor(connects); addr != srv.Addr {
+		t.Errorf("connected to %s, want %s", addr, srv.Addr)
+	}
+
+	//Losing the connection reports the error and the worker reconnects. OnConnect is called before
+	//the server has necessarily accepted the connection, so wait for it before closing it.
+	srv.WaitForConns(t, 1, waitTimeout)
+	srv.CloseClientConnections()
+
+	select {
+	case err := <-disconnects:
+		if err == nil {
+			t.Error("disconnected without an error")
+		}
+	case <-time.After(waitTimeout):
+		t.Fatal("timed out waiting for disconnection")
+	}
+
+	waitFor(connects)
+
+	srv.WaitForJobState(t, srv.Put("jobs", []byte("{}"), 0, 0, time.Minute), beanstalktest.StateDeleted, waitTimeout)
+}
+
+func TestWorkerMultipleServers(t *testing.T) {
+	srvA := beanstalktest.NewServer()
+	defer srvA.Close()
+
+	srvB := beanstalktest.NewServer()
+	defer srvB.Close()
+
+	type handledJob struct {
+		server string
+		data   Job1Data
+	}
+
+	connects := make(chan string, 10)
+	handled := make(chan handledJob, 10)
+
+	w := beanstalkworker.NewWorker(srvA.Addr, srvB.Addr)
+	w.SetReconnectPolicy(&beanstalkworker.ReconnectPolicy{InitialDelay: 10 * time.Millisecond})
+	w.OnConnect(func(addr string) { connects <- addr })
+	beanstalkworker.SubscribeFunc(w, "jobs", func(jobMgr beanstalkworker.Job, data Job1Data) {
+		handled <- handledJob{jobMgr.GetServer(), data}
+		jobMgr.Delete()
+	})
+
+	runWorker(t, w)
+
+	//Jobs from both servers are handled, and know which server they came from.
+	consume := func() {
+		t.Helper()
+
+		srvA.Put("jobs", []byte(`{"someField":"a"}`), 0, 0, time.Minute)
+		srvB.Put("jobs", []byte(`{"someField":"b"}`), 0, 0, time.Minute)
+
+		for i := 0; i < 2; i++ {
+			select {
+			case job := <-handled:
+				want := map[string]string{"a": srvA.Addr, "b": srvB.Addr}[job.data.SomeField]
+				if job.server != want {
+					t.Errorf("job from server %s reported server %s", want, job.server)
+				}
+			case <-time.After(waitTimeout):
+				t.Fatal("timed out waiting for jobs")
+			}
+		}
+
+		srvA.WaitForCounts(t, "jobs", beanstalktest.Counts{}, waitTimeout)
+		srvB.WaitForCounts(t, "jobs", beanstalktest.Counts{}, waitTimeout)
+	}
+
+	consume()
+
+	//Each server reconnects on its own when it drops its clients.
+	srvA.WaitForConns(t, 1, waitTimeout)
+	srvB.WaitForConns(t, 1, waitTimeout)
+	for len(connects) > 0 {
+		<-connects
+	}
+
+	srvA.CloseClientConnections()
+	select {
+	case addr := <-connects:
+		if addr != srvA.Addr {
+			t.Errorf("reconnected to %s, want %s", addr, srvA.Addr)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatal("timed out waiting for reconnection")
+	}
+
+	consume()
+
+	if len(connects) != 0 {
+		t.Errorf("%d more connections made, want only the dropped server reconnected", len(connects))
+	}
+
+	if n := srvB.Conns(); n != 1 {
+		t.Errorf("server B has %d connections, want its original connection", n)
+	}
+}
+
+func TestWorkerReconnectGivesUp(t *testing.T) {
+	w := beanstalkworker.NewWorker(unreachableAddr(t))
+	w.SetReconnectPolicy(&beanstalkworker.ReconnectPolicy{InitialDelay: 10 * time.Millisecond, MaxAttempts: 3})
+	beanstalkworker.SubscribeFunc(w, "jobs", func(jobMgr beanstalkworker.Job, data Job1Data) {})
+
+	if err := w.Run(context.Background()); !errors.Is(err, beanstalkworker.ErrReconnectAttemptsExhausted) {
+		t.Fatalf("Run returned %v, want ErrReconnectAttemptsExhausted", err)
+	}
+}
+
+func TestWorkerRunInvalidConfig(t *testing.T) {
+	if err := beanstalkworker.NewWorker("127.0.0.1:11300").Run(context.Background()); !errors.Is(err, beanstalkworker.ErrNoSubscriptions) {
+		t.Errorf("Run without subscriptions returned %v, want ErrNoSubscriptions", err)
+	}
+
+	w := beanstalkworker.NewWorker()
+	beanstalkworker.SubscribeFunc(w, "jobs", func(jobMgr beanstalkworker.Job, data Job1Data) {})
+	if err := w.Run(context.Background()); !errors.Is(err, beanstalkworker.ErrNoServers) {
+		t.Errorf("Run without servers returned %v, want ErrNoServers", err)
+	}
+
+	w = beanstalkworker.NewWorker("127.0.0.1:11300")
+	beanstalkworker.SubscribeFunc(w, "jobs", func(jobMgr beanstalkworker.Job, data Job1Data) {})
+	w.Subscribe("invalid", func(data Job1Data) {})
+	err := w.Run(context.Background())
+	if !errors.Is(err, beanstalkworker.ErrInvalidHandler) || !errors.Is(err, beanstalkworker.ErrInvalidConfig) {
+		t.Errorf("Run with invalid handler returned %v, want ErrInvalidHandler", err)
+	}
+}
+
+func TestWorkerLifecycleErrors(t *testing.T) {
+	srv := beanstalktest.NewServer()
+	defer srv.Close()
+
+	errs := make(chan error, 1)
+	started := make(chan struct{}, 1)
+	proceed := make(chan struct{})
+
+	var logs syncBuffer
+	w := beanstalkworker.NewWorker(srv.Addr)
+	w.SetLogger(beanstalkworker.NewSlogLogger(slog.NewJSONHandler(&logs, nil)))
+	w.SetReconnectPolicy(&beanstalkworker.ReconnectPolicy{InitialDelay: 10 * time.Millisecond})
+	beanstalkworker.SubscribeFunc(w, "twice", func(jobMgr beanstalkworker.Job, data Job1Data) {
+		jobMgr.Delete()
+		errs <- jobMgr.TryDelete()
+	})
+
+	beanstalkworker.SubscribeFunc(w, "bury", func(jobMgr beanstalkworker.Job, data Job1Data) {
+		errs <- jobMgr.TryBury()
+		errs <- jobMgr.TryBury()
+	})
+
+	beanstalkworker.SubscribeFunc(w, "lost", func(jobMgr beanstalkworker.Job, data Job1Data) {
+		started <- struct{}{}
+		<-proceed
+		errs <- jobMgr.TryRelease()
+	})
+
+	runWorker(t, w)
+
+	waitErr := func() error {
+		t.Helper()
+
+		select {
+		case err := <-errs:
+			return err
+		case <-time.After(waitTimeout):
+			t.Fatal("timed out waiting for handler")
+			return nil
+		}
+	}
+
+	id := srv.Put("twice", []byte("{}"), 0, 0, time.Minute)
+	err := waitErr()
+
+	var jobErr *beanstalkworker.JobError
+	if !errors.Is(err, beanstalkworker.ErrJobNotFound) || !errors.As(err, &jobErr) || jobErr.Op != "delete" {
+		t.Errorf("second Delete returned %v, want a delete JobError wrapping ErrJobNotFound", err)
+	}
+
+	//The failure is logged with the job's details.
+	if want := fmt.Sprintf(`"tube":"twice","job_id":%d`, id); !strings.Contains(logs.String(), want) {
+		t.Errorf("delete failure not logged with %s, logs were %s", want, logs.String())
+	}
+
+	id = srv.Put("bury", []byte("{}"), 0, 0, time.Minute)
+	if err := waitErr(); err != nil {
+		t.Errorf("TryBury returned %v", err)
+	}
+
+	if err := waitErr(); !errors.Is(err, beanstalkworker.ErrJobNotFound) || !errors.As(err, &jobErr) || jobErr.Op != "bury" {
+		t.Errorf("second TryBury returned %v, want a bury JobError wrapping ErrJobNotFound", err)
+	}
+
+	srv.AssertJobState(t, id, beanstalktest.StateBuried)
+
+	srv.Put("lost", []byte("{}"), 0, 0, time.Minute)
+	select {
+	case <-started:
+	case <-time.After(waitTimeout):
+		t.Fatal("handler not started")
+	}
+
+	srv.CloseClientConnections()
+	close(proceed)
+
+	if err := waitErr(); !errors.Is(err, beanstalkworker.ErrConnectionLost) {
+		t.Errorf("Release after losing the connection returned %v, want ErrConnectionLost", err)
+	}
+}
+
+func TestWorkerJobStats(t *testing.T) {
+	srv := beanstalktest.NewServer()
+	defer srv.Close()
+
+	type jobStats struct {
+		id       uint64
+		state    string
+		ttr      time.Duration
+		timeLeft time.Duration
+		buries   uint32
+		kicks    uint32
+		err      error
+	}
+
+	stats := make(chan jobStats, 1)
+	w := beanstalkworker.NewWorker(srv.Addr)
+	beanstalkworker.SubscribeFunc(w, "jobs", func(jobMgr beanstalkworker.Job, data Job1Data) {
+		jobMgr.Delete()
+
+		//The job no longer exists once deleted.
+		err := jobMgr.RefreshStats()
+		stats <- jobStats{jobMgr.GetID(), jobMgr.GetState(), jobMgr.GetTTR(), jobMgr.GetTimeLeft(), jobMgr.GetBuries(), jobMgr.GetKicks(), err}
+	})
+
+	//Bury and kick the job before the worker reserves it.
+	id := srv.Put("jobs", []byte("{}"), 0, 0, 30*time.Second)
+	conn, err := beanstalk.Dial("tcp", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	if _, _, err := beanstalk.NewTubeSet(conn, "jobs").Reserve(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.Bury(id, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.KickJob(id); err != nil {
+		t.Fatal(err)
+	}
+
+	runWorker(t, w)
+
+	var got jobStats
+	select {
+	case got = <-stats:
+	case <-time.After(waitTimeout):
+		t.Fatal("handler not run")
+	}
+
+	if got.id != id || got.state != "reserved" || got.ttr != 30*time.Second || got.timeLeft <= 0 || got.buries != 1 || got.kicks != 1 {
+		t.Errorf("job stats are %+v", got)
+	}
+
+	if !errors.Is(got.err, beanstalkworker.ErrJobNotFound) {
+		t.Errorf("RefreshStats of deleted job returned %v, want ErrJobNotFound", got.err)
+	}
+}
+
+func TestWorkerAutoTouch(t *testing.T) {
+	srv := beanstalktest.NewServer()
+	defer srv.Close()
+
+	var mu sync.Mutex
+	calls := 0
+	started := make(chan struct{}, 2)
+
+	//The handler runs for longer than the job's TTR, with a spare worker thread that would
+	//reserve the job again if it timed out.
+	w := beanstalkworker.NewWorker(srv.Addr)
+	w.SetNumWorkers(2)
+	beanstalkworker.SubscribeFunc(w, "slow", func(jobMgr beanstalkworker.Job, data Job1Data) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+
+		started <- struct{}{}
+		time.Sleep(2500 * time.Millisecond)
+		jobMgr.Delete()
+	}, beanstalkworker.WithAutoTouch())
+
+	id := srv.Put("slow", []byte("{}"), 0, 0, time.Second)
+	runWorker(t, w)
+
+	select {
+	case <-started:
+	case <-time.After(waitTimeout):
+		t.Fatal("handler not started")
+	}
+
+	//Past the TTR the job is still reserved by the first handler and has not timed out.
+	time.Sleep(1500 * time.Millisecond)
+	job, _ := srv.Job(id)
+	if job.State != beanstalktest.StateReserved || job.Reserves != 1 || job.Timeouts != 0 {
+		t.Errorf("job is %s, reserved %d times and timed out %d times, want reserved once without timing out", job.State, job.Reserves, job.Timeouts)
+	}
+
+	srv.WaitForJobState(t, id, beanstalktest.StateDeleted, waitTimeout)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Errorf("handler called %d times, want 1", calls)
+	}
+}
+
+func TestWorkerStopsReservingWhenDraining(t *testing.T) {
+	srv := beanstalktest.NewServer()
+	defer srv.Close()
+
+	started := make(chan struct{}, 1)
+	proceed := make(chan struct{})
+
+	w := beanstalkworker.NewWorker(srv.Addr)
+	w.SetReserveTimeout(time.Second)
+	beanstalkworker.SubscribeFunc(w, "jobs", func(jobMgr beanstalkworker.Job, data Job1Data) {
+		started <- struct{}{}
+		<-proceed
+		jobMgr.Delete()
+	})
+
+	first := srv.Put("jobs", []byte("{}"), 0, 0, time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(waitTimeout):
+		t.Fatal("handler not started")
+	}
+
+	//A job put whilst the worker is draining must not be reserved.
+	cancel()
+	second := srv.Put("jobs", []byte("{}"), 0, 0, time.Minute)
+	close(proceed)
+
+	select {
+	case <-done:
+	case <-time.After(waitTimeout):
+		t.Fatal("worker did not stop")
+	}
+
+	srv.AssertJobState(t, first, beanstalktest.StateDeleted)
+	if job, _ := srv.Job(second); job.State != beanstalktest.StateReady || job.Reserves != 0 {
+		t.Errorf("job put whilst draining is %s with %d reserves, want ready and never reserved", job.State, job.Reserves)
+	}
+
+	if report := w.ShutdownReport(); report.Drained != 1 || report.Released != 0 {
+		t.Errorf("shutdown report is %+v, want 1 drained and 0 released", report)
+	}
+}
+
+func TestWorkerReservesOnlyJobsItCanRun(t *testing.T) {
+	srv := beanstalktest.NewServer()
+	defer srv.Close()
+
+	type handled struct {
+		id       uint64
+		reserves uint32
+		releases uint32
+	}
+
+	started := make(chan handled, 4)
+	proceed := make(chan struct{})
+	handler := func(jobMgr beanstalkworker.Job, data Job1Data) {
+		started <- handled{jobMgr.GetID(), jobMgr.GetReserves(), jobMgr.GetReleases()}
+		<-proceed
+		jobMgr.Delete()
+	}
+
+	//A ceiling of two jobs, with at most one from the limited tube.
+	w := beanstalkworker.NewWorker(srv.Addr)
+	w.SetNumWorkers(2)
+	beanstalkworker.SubscribeFunc(w, "limited", handler, beanstalkworker.WithConcurrency(1))
+	beanstalkworker.SubscribeFunc(w, "shared", handler)
+	runWorker(t, w)
+
+	limited := srv.Put("limited", []byte("{}"), 0, 0, time.Minute)
+	limitedWaiting := srv.Put("limited", []byte("{}"), 0, 0, time.Minute)
+	srv.WaitForCounts(t, "limited", beanstalktest.Counts{Ready: 1, Reserved: 1}, waitTimeout)
+
+	//Whilst the limited tube is at its limit the other thread still handles jobs from the shared tube.
+	shared := srv.Put("shared", []byte("{}"), 0, 0, time.Minute)
+	srv.WaitForJobState(t, shared, beanstalktest.StateReserved, waitTimeout)
+
+	//Whilst the ceiling is reached, jobs are left ready rather than reserved and handed back,
+	//which would use up their reserves and releases, and so their retry policy.
+	sharedWaiting := srv.Put("shared", []byte("{}"), 0, 0, time.Minute)
+	time.Sleep(100 * time.Millisecond)
+	for _, id := range []uint64{limitedWaiting, sharedWaiting} {
+		if job, _ := srv.Job(id); job.State != beanstalktest.StateReady || job.Reserves != 0 {
+			t.Errorf("waiting job %d is %s with %d reserves, want ready and never reserved", id, job.State, job.Reserves)
+		}
+	}
+
+	close(proceed)
+	for _, id := range []uint64{limited, limitedWaiting, shared, sharedWaiting} {
+		srv.WaitForJobState(t, id, beanstalktest.StateDeleted, waitTimeout)
+	}
+
+	close(started)
+	for job := range started {
+		if job.reserves != 1 || job.releases != 0 {
+			t.Errorf("job %d handled with %d reserves and %d releases, want 1 reserve and no releases", job.id, job.reserves, job.releases)
+		}
+	}
+}
+
+func TestWorkerRawBodyHandlers(t *testing.T) {
+	srv := beanstalktest.NewServer()
+	defer srv.Close()
+
+	bodies := make(chan []byte, 1)
+	w := beanstalkworker.NewWorker(srv.Addr)
+	w.Subscribe("manager", func(jobMgr beanstalkworker.JobManager, body []byte) {
+		bodies <- body
+		jobMgr.Delete()
+	})
+
+	w.Subscribe("manager-err", func(jobMgr beanstalkworker.JobManager, body []byte) error {
+		bodies <- body
+		return nil
+	})
+
+	w.Subscribe("raw-job", func(job *beanstalkworker.RawJob) {
+		bodies <- job.GetBody()
+		job.Delete()
+	})
+
+	w.Subscribe("raw-job-ctx", func(ctx context.Context, job *beanstalkworker.RawJob) error {
+		bodies <- job.GetBody()
+		return nil
+	})
+
+	beanstalkworker.SubscribeFunc(w, "func", func(jobMgr beanstalkworker.Job, body []byte) {
+		bodies <- body
+		jobMgr.Delete()
+	})
+
+	runWorker(t, w)
+
+	envelope := `{"headers":{"Content-Type":"text/plain"},"payload":"dGV4dA=="}`
+	tests := []struct {
+		tube string
+		body string
+		want string
+	}{
+		//Bodies that aren't valid for the worker's codec are passed untouched.
+		{"manager", "plain text", "plain text"},
+		{"manager-err", "\x00\x01\xff", "\x00\x01\xff"},
+		{"func", "{not json", "{not json"},
+		{"raw-job", "plain text", "plain text"},
+		{"raw-job-ctx", "\x00\x01\xff", "\x00\x01\xff"},
+
+		//Payload handlers are passed an envelope's payload, whereas GetBody returns the whole body.
+		{"manager", envelope, "text"},
+		{"func", envelope, "text"},
+		{"raw-job", envelope, envelope},
+	}
+
+	for _, test := range tests {
+		id := srv.Put(test.tube, []byte(test.body), 0, 0, time.Minute)
+
+		select {
+		case got := <-bodies:
+			if string(got) != test.want {
+				t.Errorf("%s handler passed %q for body %q, want %q", test.tube, got, test.body, test.want)
+			}
+		case <-time.After(waitTimeout):
+			t.Fatalf("%s handler not run", test.tube)
+		}
+
+		srv.WaitForJobState(t, id, beanstalktest.StateDeleted, waitTimeout)
+	}
+}
+
+// syncBuffer is a bytes.Buffer that is safe to write to from the worker's goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// legacyJobManager implements JobManager as it was before Job was added, to check that
+// existing implementations still compile.
+type legacyJobManager struct{}
+
+func (legacyJobManager) Delete()                            {}
+func (legacyJobManager) Touch()                             {}
+func (legacyJobManager) Release()                           {}
+func (legacyJobManager) LogError(a ...interface{})          {}
+func (legacyJobManager) LogInfo(a ...interface{})           {}
+func (legacyJobManager) GetAge() time.Duration              { return 0 }
+func (legacyJobManager) GetPriority() uint32                { return 0 }
+func (legacyJobManager) GetReleases() uint32                { return 0 }
+func (legacyJobManager) GetReserves() uint32                { return 0 }
+func (legacyJobManager) GetTimeouts() uint32                { return 0 }
+func (legacyJobManager) GetDelay() time.Duration            { return 0 }
+func (legacyJobManager) GetTube() string                    { return "" }
+func (legacyJobManager) GetConn() *beanstalk.Conn           { return nil }
+func (legacyJobManager) SetReturnPriority(prio uint32)      {}
+func (legacyJobManager) SetReturnDelay(delay time.Duration) {}
+
+var _ beanstalkworker.JobManager = legacyJobManager{}
+
+func TestWorkerSubscribeJobManager(t *testing.T) {
+	srv := beanstalktest.NewServer()
+	defer srv.Close()
+
+	//Handlers written against JobManager can still be subscribed, as can those needing the *RawJob.
+	w := beanstalkworker.NewWorker(srv.Addr)
+	w.Subscribe("legacy", func(jobMgr beanstalkworker.JobManager, data Job1Data) {
+		jobMgr.Delete()
+	})
+
+	beanstalkworker.SubscribeFunc(w, "func", func(jobMgr beanstalkworker.JobManager, data Job1Data) {
+		jobMgr.Delete()
+	})
+
+	beanstalkworker.SubscribeFuncErr(w, "func-err", func(jobMgr beanstalkworker.JobManager, data Job1Data) error {
+		return nil
+	})
+
+	beanstalkworker.SubscribeFuncCtx(w, "func-ctx", func(ctx context.Context, job *beanstalkworker.RawJob, data Job1Data) error {
+		return job.TryDelete()
+	})
+
+	runWorker(t, w)
+
+	for _, tube := range []string{"legacy", "func", "func-err", "func-ctx"} {
+		srv.WaitForJobState(t, srv.Put(tube, []byte(`{"someField":"value"}`), 0, 0, time.Minute), beanstalktest.StateDeleted, waitTimeout)
+	}
+}
+
+func TestWorkerSubscribeFuncInvalidJobType(t *testing.T) {
+	//The worker can't pass its jobs to handlers accepting another implementation of JobManager.
+	w := beanstalkworker.NewWorker("127.0.0.1:0")
+	beanstalkworker.SubscribeFunc(w, "jobs", func(jobMgr legacyJobManager, data Job1Data) {})
+
+	if err := w.Run(context.Background()); !errors.Is(err, beanstalkworker.ErrInvalidHandler) {
+		t.Errorf("Run returned %v, want ErrInvalidHandler", err)
+	}
+}